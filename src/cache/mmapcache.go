@@ -2,7 +2,12 @@ package cache
 
 import (
 	"errors"
+	"fmt"
+	"hash/crc32"
 	"os"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/edsrzf/mmap-go"
 
@@ -14,66 +19,204 @@ const (
 	mmapCacheHeadVersionPos  = 4
 	mmapCacheHeadStatusPos   = mmapCacheHeadVersionPos + 2
 	mmapCacheHeadDataSizePos = mmapCacheHeadStatusPos + 2
+	mmapCacheHeadLayoutPos   = mmapCacheHeadDataSizePos + 4
+	mmapCacheHeadMagicPos    = mmapCacheHeadLayoutPos + 4
+	mmapCacheHeadCrcPos      = mmapCacheHeadMagicPos + 4
+	mmapCacheHeadSealPos     = mmapCacheHeadCrcPos + 4
 	mmapCacheContentPos      = mmapCacheHeadSize
+
+	mmapCacheVersionV1 uint16 = 0x1
+	mmapCacheVersionV2 uint16 = 0x2 // version 2 起数据块带有checksum
+	mmapCacheVersionV3 uint16 = 0x3 // version 3 起数据块带有seq
+	mmapCacheVersion   uint16 = 0x4 // version 4 起文件头带有magic与checksum
+
+	mmapCacheMagic uint32 = 0x4d4d4346 // "MMCF"
+)
+
+// liveMappings 当前进程中尚未Unmap的mmap映射数量，用于检查映射泄漏
+var liveMappings int64
+
+// LiveMappings 获取当前进程中尚未Unmap的mmap映射数量（所有缓存池以及单独创建的MMapCache）
+// 所有缓存池Close、分配出的MMapCache都Release之后应归零，用于检查映射泄漏
+func LiveMappings() int64 {
+	return atomic.LoadInt64(&liveMappings)
+}
+
+var (
+	// ErrDataSizeOverflow 待写入对象超出了数据块的大小
+	ErrDataSizeOverflow = errors.New("mmap cache data.size over follow")
+	// ErrKeySizeOverflow key的长度超出了数据块head中keylen能记录的范围（65535）
+	ErrKeySizeOverflow = errors.New("mmap cache key.size over follow")
+	// ErrUnknownVersion 文件的version无法识别
+	ErrUnknownVersion = errors.New("mmap cache unknown version")
+	// ErrBadHead 文件头损坏（文件过小、magic或checksum不匹配）
+	ErrBadHead = errors.New("mmap cache bad head")
+	// ErrCorruptContent 文件内容损坏，无法继续解析数据块
+	ErrCorruptContent = errors.New("mmap cache corrupt content")
+	// ErrCacheReleased 并发模式下，MMapCache已Release后不能再写入
+	ErrCacheReleased = errors.New("mmap cache released")
+)
+
+// Layout 缓存文件中数据块的分配方式
+type Layout uint16
+
+const (
+	// LayoutFixed 每个数据块固定分配datasize长度
+	LayoutFixed Layout = 0
+	// LayoutVariable 每个数据块按 head+key+data 的实际长度分配，并按datasize对齐
+	LayoutVariable Layout = 1
 )
 
 // MMapCache 基于mmap模式的文件缓存
-// | ---------------------- head ---------------------------------------| ------------ content -----------|
-// | 4byte:content.len | 2byte:version  | 2byte:status | 4byte:datasize |   mmapdata.go  |   mmapdata.go  |
+// | ---------------------- head ----------------------------------------------------------------------------------------------------| ------------ content -----------|
+// | 4byte:content.len | 2byte:version  | 2byte:status | 4byte:datasize | 2byte:layout | 2byte:reserved | 4byte:magic | 4byte:headcrc | 8byte:sealtime |   mmapdata.go  |   mmapdata.go  |
+// headcrc为 version+datasize+layout+magic 的CRC32C，content.len、status与sealtime会修改，不参与校验
+// sealtime为封存时间（unix纳秒），0表示未封存；version 4 之前的文件此处为0
 type MMapCache struct {
+	pool             *PoolMMapCache // 所属的缓存池，Release时回收到此缓存池
 	path             string
 	f                *os.File
-	buf              []byte // mmap后的文件原始内存
-	writeContent     []byte // content部分的内存对象
-	writeUint32Cache []byte // 内存写缓存，保证一次copy写内存，防止按字节写出错
-	dataSize         int    // 每次data的固定分配长度，可以支持快速写，但是弊端就是需要提前设计好将要写入的数据最大长度，否则会有数据写失败
+	mmap             mmap.MMap // 文件的mmap映射，close时Unmap；ReloadMMapCache加载的对象为nil
+	buf              []byte    // mmap后的文件原始内存
+	writeContent     []byte    // content部分的内存对象
+	writeUint32Cache []byte    // 内存写缓存，保证一次copy写内存，防止按字节写出错
+	dataSize         int       // 每次data的固定分配长度，可以支持快速写，但是弊端就是需要提前设计好将要写入的数据最大长度，否则会有数据写失败
+	layout           Layout    // LayoutVariable时，dataSize为数据块的对齐长度
+	dataHeadLen      int       // 数据块head长度，由文件的version决定
 	readPos          int
 	writePos         int
 	mmapdataIdx      map[string]*MMapData
 	mmapdataAry      []*MMapData
+	freeSlots        [][]byte    // 已删除数据块的内存，新key优先复用这些数据块
+	freeSize         int         // freeSlots的总大小
+	corruptAry       []*MMapData // reload时checksum校验失败的数据块
+	syncPolicy       SyncPolicy
+	syncWrites       int          // SyncEveryN 时距离上次刷盘的写入次数
+	syncPending      int32        // SyncInterval 时是否已有待触发的刷盘
+	syncTimer        *time.Timer  // SyncInterval 时待触发的刷盘
+	syncMu           sync.Mutex   // 定时刷盘与close互斥，避免刷盘时映射被解除
+	concurrent       bool         // 并发模式，公开方法通过mu加锁，见SetConcurrent
+	mu               sync.RWMutex // 并发模式下保护索引、数据块与writePos
+	released         bool         // 并发模式下已Release，之后的写入返回ErrCacheReleased
 }
 
-func newMMapCache(filePath string, dataSize int, reload bool) (*MMapCache, error) {
+func newMMapCache(filePath string, layout Layout, dataSize int, reload bool) (*MMapCache, error) {
 	f, err := os.OpenFile(filePath, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0)
 	if nil != err {
 		return nil, err
 	}
 	buf, err := mmap.MapRegion(f, -1, mmap.RDWR, 0, 0)
 	if nil != err {
+		f.Close()
 		return nil, err
 	}
+	if len(buf) < mmapCacheHeadSize {
+		buf.Unmap()
+		f.Close()
+		return nil, ErrBadHead
+	}
+	atomic.AddInt64(&liveMappings, 1)
 
 	mmcache := &MMapCache{
 		path:             filePath,
 		f:                f,
+		mmap:             buf,
 		buf:              buf,
 		writeContent:     buf[mmapCacheContentPos:],
 		writeUint32Cache: make([]byte, 4),
 		dataSize:         dataSize,
+		layout:           layout,
 	}
 
-	byteio.Uint16ToBytes(uint16(0x1), mmcache.buf[mmapCacheHeadVersionPos:])
-	byteio.Uint32ToBytes(uint32(dataSize), mmcache.buf[mmapCacheHeadDataSizePos:])
-	mmcache.init(reload)
+	// 已有数据的文件保留原有的分配方式，否则reload时无法正确解析数据块
+	if !reload || 0 == mmcache.getWritePos() {
+		mmcache.setHead(layout, dataSize)
+	} else if err := mmcache.checkHead(); nil != err {
+		mmcache.close(false)
+		return nil, err
+	}
+	if err := mmcache.init(reload); nil != err {
+		mmcache.close(false)
+		return nil, err
+	}
 	return mmcache, nil
 }
 
 // ReloadMMapCache 通过内存对象
 // 反序列化出之前的MMapCache对象与MMapCache对象中的MMapData
+// buf中有损坏的数据块时，只返回损坏位置之前的数据块；buf小于文件头长度时返回nil
 func ReloadMMapCache(buf []byte) *MMapCache {
+	if len(buf) < mmapCacheHeadSize {
+		return nil
+	}
 	mmcache := &MMapCache{
-		buf:          buf,
-		writeContent: buf[mmapCacheContentPos:],
+		buf:              buf,
+		writeContent:     buf[mmapCacheContentPos:],
+		writeUint32Cache: make([]byte, 4),
 	}
 
 	mmcache.init(true)
 	return mmcache
 }
 
-// Release 释放，将此mmap文件丢到pool中，由pool的策略决定释放真正释放
+// SetConcurrent 设置并发模式，需要在多个goroutine共享MMapCache之前调用
+// 并发模式下：
+//   - WriteData、Delete、SetStatus 互斥执行，Get、Has、Len、GetMMapDatas 等读方法可以与之并发调用
+//   - GetMMapDatas 返回调用时刻的快照，之后的写入不会修改返回的slice
+//   - Release 会等待进行中的调用结束，之后的WriteData返回 ErrCacheReleased，Delete返回false；重复Release是安全的
+//   - 返回的MMapData对象本身（如ReloadVal）不受保护，由业务层自行保证
+//
+// 非并发模式（默认）不加锁，由业务层保证同一时刻只有一个goroutine访问
+func (m *MMapCache) SetConcurrent(concurrent bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.concurrent = concurrent
+}
+
+func (m *MMapCache) lock() {
+	if m.concurrent {
+		m.mu.Lock()
+	}
+}
+
+func (m *MMapCache) unlock() {
+	if m.concurrent {
+		m.mu.Unlock()
+	}
+}
+
+func (m *MMapCache) rlock() {
+	if m.concurrent {
+		m.mu.RLock()
+	}
+}
+
+func (m *MMapCache) runlock() {
+	if m.concurrent {
+		m.mu.RUnlock()
+	}
+}
+
+// prepare 从缓存池分配时设置刷盘策略与并发模式
+func (m *MMapCache) prepare(policy SyncPolicy, concurrent bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.syncPolicy = policy
+	m.concurrent = concurrent
+	m.released = false
+}
+
+// Release 释放，将此mmap文件丢到所属的pool中，由pool的策略决定释放真正释放
 func (m *MMapCache) Release() {
-	if nil != m.f {
-		DefPoolMMapCache.Collect(m)
+	m.lock()
+	released := m.released
+	m.released = m.concurrent
+	m.unlock()
+	if released {
+		return
+	}
+	if nil != m.f && nil != m.pool {
+		m.pool.Collect(m)
 	}
 }
 
@@ -82,6 +225,11 @@ func (m *MMapCache) Path() string {
 	return m.path
 }
 
+// Layout 缓存文件中数据块的分配方式
+func (m *MMapCache) Layout() Layout {
+	return m.layout
+}
+
 // GetMMapDatas 获取当前Cache文件中存储的所有mmapdata对象
 // 当通过Reload加载完毕MMapCache文件后，调用此方法获取到所有文件内的对象数据，然后通过反序列化初始化出内存对象
 // for _, mmapdata := range GetMMapDatas() {
@@ -89,57 +237,192 @@ func (m *MMapCache) Path() string {
 //     mmapdata.ReloadVal(val)
 // }
 func (m *MMapCache) GetMMapDatas() []*MMapData {
+	m.rlock()
+	defer m.runlock()
+	if m.concurrent {
+		return append([]*MMapData(nil), m.mmapdataAry...)
+	}
 	return m.mmapdataAry
 }
 
+// Get 通过key获取已写入的mmapdata对象
+func (m *MMapCache) Get(key []byte) (*MMapData, bool) {
+	m.rlock()
+	defer m.runlock()
+	mmapData, ok := m.mmapdataIdx[string(key)]
+	return mmapData, ok
+}
+
+// Has 判断key是否已写入当前Cache文件
+func (m *MMapCache) Has(key []byte) bool {
+	m.rlock()
+	defer m.runlock()
+	_, ok := m.mmapdataIdx[string(key)]
+	return ok
+}
+
+// Len 返回当前Cache文件中存储的mmapdata对象数量
+func (m *MMapCache) Len() int {
+	m.rlock()
+	defer m.runlock()
+	return len(m.mmapdataAry)
+}
+
+// GetCorruptMMapDatas 获取reload时校验失败的mmapdata对象
+// 这些数据块不会出现在GetMMapDatas中，也不会被复用，只用于排查问题
+func (m *MMapCache) GetCorruptMMapDatas() []*MMapData {
+	return m.corruptAry
+}
+
 // WriteData 写入一片内存对象
 // 返回 (-1, nil) 表示当前mmap对象已无可用空间
-// 返回 (0, error)，表示当前的待写入对象，超出了mmap对象的datasize
+// 返回 (0, ErrDataSizeOverflow)，表示当前的待写入对象，超出了mmap对象的datasize
+// 返回 (0, ErrKeySizeOverflow)，表示key的长度超过65535
+// 写入成功但按刷盘策略刷盘失败时，返回 (len(data), error)
+//
+// 更新已有key时不会覆盖原数据块，而是写入一个新的数据块（seq+1）后再删除旧数据块，
+// 崩溃后reload要么看到旧数据，要么看到新数据，不会看到写了一半的数据；
+// 因此更新也需要一个空闲的数据块，没有时返回 (-1, nil)，旧数据保持不变
 func (m *MMapCache) WriteData(tag uint16, data, key []byte, val interface{}) (int, error) {
+	m.lock()
+	defer m.unlock()
+	if m.released {
+		return 0, ErrCacheReleased
+	}
+
 	// 判断是否已经有这个缓存了
 	mmapData, _ := m.mmapdataIdx[string(key)]
 	if nil == mmapData {
-		if m.writePos+m.dataSize+mmapCacheHeadSize > len(m.buf) {
-			return -1, nil
+		mmapData, err := m.allocData(tag, 0, key, data, val)
+		if nil != err {
+			return 0, err
 		}
-
-		writeBuf := m.writeContent[m.writePos:]
-		mmapData = newMMapData(uint32(m.dataSize), tag, writeBuf, key, data, val)
 		if nil == mmapData {
-			return 0, errors.New("mmap cache data.size over follow")
+			return -1, nil
 		}
 
 		m.mmapdataIdx[string(key)] = mmapData
 		m.mmapdataAry = append(m.mmapdataAry, mmapData)
-		m.setWritePos(m.writePos + m.dataSize)
+		return len(data), m.sync()
 	}
 
-	mmapData.writeData(data)
-	return len(data), nil
+	newData, err := m.allocData(mmapData.GetTag(), mmapData.getSeq()+1, key, data, mmapData.GetVal())
+	if nil != err {
+		return 0, err
+	}
+	if nil == newData {
+		return -1, nil
+	}
+
+	// 新数据块生效后再删除旧数据块
+	m.barrierCommit(newData)
+	mmapData.markDeleted(m.writeUint32Cache)
+	m.mmapdataIdx[string(key)] = newData
+	for i, v := range m.mmapdataAry {
+		if v == mmapData {
+			m.mmapdataAry[i] = newData
+			break
+		}
+	}
+	m.pushFreeSlot(mmapData)
+	return len(data), m.sync()
+}
+
+// Delete 删除一片内存对象
+// 数据块在文件中被标记为删除（墓碑），reload时不会再被加载，其内存会被之后写入的新key复用
+// 返回 false 表示key不存在
+func (m *MMapCache) Delete(key []byte) bool {
+	m.lock()
+	defer m.unlock()
+	if m.released {
+		return false
+	}
+
+	mmapData, _ := m.mmapdataIdx[string(key)]
+	if nil == mmapData {
+		return false
+	}
+
+	mmapData.markDeleted(m.writeUint32Cache)
+	delete(m.mmapdataIdx, string(key))
+	for i, v := range m.mmapdataAry {
+		if v == mmapData {
+			m.mmapdataAry = append(m.mmapdataAry[:i], m.mmapdataAry[i+1:]...)
+			break
+		}
+	}
+	m.pushFreeSlot(mmapData)
+	m.sync()
+	return true
 }
 
 // GetWrittenData 返回有数据的mmap内存
+// 并发模式下返回的是调用时刻的长度，内存本身仍会被之后的写入修改
 func (m *MMapCache) GetWrittenData() []byte {
+	m.rlock()
+	defer m.runlock()
 	return m.buf[:mmapCacheHeadSize+m.writePos]
 }
 
-// GetFreeContentLen 返回可写入的空余内存大小
+// GetFreeContentLen 返回可写入的空余内存大小（包含可复用的已删除数据块）
 func (m *MMapCache) GetFreeContentLen() int {
-	return len(m.writeContent) - m.writePos
+	m.rlock()
+	defer m.runlock()
+	return len(m.writeContent) - m.writePos + m.freeSize
 }
 
 // SetStatus 设置自定义状态
 func (m *MMapCache) SetStatus(s uint16) {
+	m.lock()
+	defer m.unlock()
 	byteio.Uint16ToBytes(s, m.buf[mmapCacheHeadStatusPos:])
 }
 
 // GetStatus 获取自定义状态
 func (m *MMapCache) GetStatus() uint16 {
+	m.rlock()
+	defer m.runlock()
 	return byteio.BytesToUint16(m.buf[mmapCacheHeadStatusPos:])
 }
 
+// Seal 标记为已封存（不再写入，等待flush），封存时间记录在文件头中
+func (m *MMapCache) Seal() {
+	m.lock()
+	defer m.unlock()
+	byteio.SafeUint64ToBytes(uint64(time.Now().UnixNano()), m.buf[mmapCacheHeadSealPos:], make([]byte, 8))
+}
+
+// SealTime 获取封存时间，未封存时返回零值
+func (m *MMapCache) SealTime() time.Time {
+	m.rlock()
+	defer m.runlock()
+	n := byteio.BytesToUint64(m.buf[mmapCacheHeadSealPos:])
+	if 0 == n {
+		return time.Time{}
+	}
+	return time.Unix(0, int64(n))
+}
+
+// close 解除mmap映射并关闭文件，remove为true时同时删除文件
+// 映射解除后buf不可再访问，重复close是安全的
 func (m *MMapCache) close(remove bool) {
-	m.f.Close()
+	m.stopSync()
+	m.syncMu.Lock()
+	defer m.syncMu.Unlock()
+	if nil != m.mmap {
+		m.mmap.Unmap()
+		m.mmap = nil
+		m.buf = nil
+		m.writeContent = nil
+		atomic.AddInt64(&liveMappings, -1)
+		if nil != m.pool {
+			atomic.AddInt64(&m.pool.liveMappings, -1)
+		}
+	}
+	if nil != m.f {
+		m.f.Close()
+		m.f = nil
+	}
 	if remove {
 		os.Remove(m.path)
 	}
@@ -150,37 +433,263 @@ func (m *MMapCache) setWritePos(n int) {
 	m.writePos = n
 }
 
+// allocData 分配数据块并写入数据，优先复用已删除的数据块
+// 数据完整写入后才提交：复用的数据块清除墓碑标记，新的数据块更新writePos
+// 返回 (nil, nil) 表示当前mmap对象已无可用空间
+func (m *MMapCache) allocData(tag uint16, seq uint32, key, data []byte, val interface{}) (*MMapData, error) {
+	if len(key) > mmapDataKeyMaxLen {
+		return nil, ErrKeySizeOverflow
+	}
+	if m.dataHeadLen+len(key)+len(data) > m.maxSlotSize() {
+		return nil, ErrDataSizeOverflow
+	}
+
+	if slotIdx := m.findFreeSlot(len(key) + len(data)); slotIdx >= 0 {
+		slot := m.freeSlots[slotIdx]
+		m.freeSlots = append(m.freeSlots[:slotIdx], m.freeSlots[slotIdx+1:]...)
+		m.freeSize -= len(slot)
+
+		mmapData := newMMapData(m.dataHeadLen, uint32(len(slot)), tag, seq, slot, key, data, val)
+		m.barrier(slot)
+		mmapData.commit(m.writeUint32Cache)
+		return mmapData, nil
+	}
+
+	size := m.slotSize(len(key) + len(data))
+	if m.writePos+size+mmapCacheHeadSize > len(m.buf) {
+		return nil, nil
+	}
+
+	mmapData := newMMapData(m.dataHeadLen, uint32(size), tag, seq, m.writeContent[m.writePos:], key, data, val)
+	mmapData.commit(m.writeUint32Cache)
+	m.barrier(mmapData.buf)
+	m.setWritePos(m.writePos + size)
+	return mmapData, nil
+}
+
+// barrier 提交数据块之前，SyncEveryWrite需要先将数据块刷盘，保证机器崩溃时也不会提交写了一半的数据块
+func (m *MMapCache) barrier(slot []byte) {
+	if SyncEveryWrite == m.syncPolicy.Mode {
+		m.FlushRange(cap(m.buf)-cap(slot), len(slot))
+	}
+}
+
+// barrierCommit 删除旧数据块之前，SyncEveryWrite需要先将新数据块的data.size与文件头的writePos刷盘，
+// 保证机器崩溃时不会只留下旧数据块的墓碑而丢失整个key
+func (m *MMapCache) barrierCommit(mmapData *MMapData) {
+	if SyncEveryWrite == m.syncPolicy.Mode {
+		m.FlushRange(cap(m.buf)-cap(mmapData.buf), mmapDataHeadUsedPos)
+		m.FlushRange(0, mmapCacheHeadVersionPos)
+	}
+}
+
+// maxSlotSize 返回单个数据块的最大长度
+func (m *MMapCache) maxSlotSize() int {
+	if LayoutVariable == m.layout {
+		return len(m.writeContent)
+	}
+	return m.dataSize
+}
+
+// slotSize 返回写入 key+data 需要分配的数据块大小
+func (m *MMapCache) slotSize(used int) int {
+	if LayoutVariable == m.layout {
+		size := used + m.dataHeadLen
+		return (size + m.dataSize - 1) / m.dataSize * m.dataSize
+	}
+	return m.dataSize
+}
+
+// findFreeSlot 查找第一个能容纳 key+data 的已删除数据块
+func (m *MMapCache) findFreeSlot(used int) int {
+	for i, slot := range m.freeSlots {
+		if used+m.dataHeadLen <= len(slot) {
+			return i
+		}
+	}
+	return -1
+}
+
+func (m *MMapCache) pushFreeSlot(mmapData *MMapData) {
+	size := int(mmapData.GetSize())
+	m.freeSlots = append(m.freeSlots, mmapData.buf[:size])
+	m.freeSize += size
+}
+
+func (m *MMapCache) setVersion(v uint16) {
+	byteio.Uint16ToBytes(v, m.buf[mmapCacheHeadVersionPos:])
+}
+
+// setHead 按当前version写入文件头
+func (m *MMapCache) setHead(layout Layout, dataSize int) {
+	m.setVersion(mmapCacheVersion)
+	byteio.Uint32ToBytes(uint32(dataSize), m.buf[mmapCacheHeadDataSizePos:])
+	byteio.Uint16ToBytes(uint16(layout), m.buf[mmapCacheHeadLayoutPos:])
+	byteio.Uint32ToBytes(mmapCacheMagic, m.buf[mmapCacheHeadMagicPos:])
+	byteio.Uint32ToBytes(m.calcHeadCrc(), m.buf[mmapCacheHeadCrcPos:])
+	byteio.Uint64ToBytes(0, m.buf[mmapCacheHeadSealPos:])
+}
+
+// checkHead 校验已有数据的文件头，version 4 之前的文件没有magic与checksum
+func (m *MMapCache) checkHead() error {
+	version := m.getVersion()
+	if 0 == version || version > mmapCacheVersion {
+		return ErrUnknownVersion
+	}
+	if version < mmapCacheVersion {
+		return nil
+	}
+	if mmapCacheMagic != byteio.BytesToUint32(m.buf[mmapCacheHeadMagicPos:]) ||
+		m.calcHeadCrc() != byteio.BytesToUint32(m.buf[mmapCacheHeadCrcPos:]) {
+		return ErrBadHead
+	}
+	return nil
+}
+
+func (m *MMapCache) calcHeadCrc() uint32 {
+	crc := crc32.Update(0, crc32cTable, m.buf[mmapCacheHeadVersionPos:mmapCacheHeadStatusPos])
+	return crc32.Update(crc, crc32cTable, m.buf[mmapCacheHeadDataSizePos:mmapCacheHeadCrcPos])
+}
+
+// dataHeadLenOf 返回对应version的数据块head长度
+func dataHeadLenOf(version uint16) int {
+	switch version {
+	case mmapCacheVersionV1:
+		return mmapDataHeadLenV1
+	case mmapCacheVersionV2:
+		return mmapDataHeadLenV2
+	case mmapCacheVersionV3:
+		return mmapDataHeadLen
+	}
+	return mmapDataHeadLen
+}
+
+func (m *MMapCache) getVersion() uint16 {
+	return byteio.BytesToUint16(m.buf[mmapCacheHeadVersionPos:])
+}
+
 func (m *MMapCache) getWritePos() int {
 	return int(byteio.BytesToUint32(m.buf))
 }
 
-func (m *MMapCache) init(reload bool) {
+// capacity 预估文件可容纳的数据块数量
+func (m *MMapCache) capacity() int {
+	if LayoutVariable == m.layout || m.dataSize <= 0 {
+		return 0
+	}
+	return (len(m.buf) - mmapCacheHeadSize) / m.dataSize
+}
+
+// init 初始化内存索引，reload时从文件内容中加载数据块
+// reload时文件内容的长度信息都会先校验，遇到第一个无法解析的数据块即停止加载，
+// 返回 ErrCorruptContent，之前已加载的数据块保留在mmapdataAry中
+func (m *MMapCache) init(reload bool) error {
 
 	if reload {
 		m.readPos = 0
 		m.writePos = m.getWritePos()
 		m.dataSize = int(byteio.BytesToUint32(m.buf[mmapCacheHeadDataSizePos:]))
+		m.layout = Layout(byteio.BytesToUint16(m.buf[mmapCacheHeadLayoutPos:]))
+		m.dataHeadLen = dataHeadLenOf(m.getVersion())
 
 		m.mmapdataIdx = make(map[string]*MMapData)
-		m.mmapdataAry = make([]*MMapData, 0, (len(m.buf)-mmapCacheHeadSize)/m.dataSize)
+		m.mmapdataAry = make([]*MMapData, 0, m.capacity())
+		m.freeSlots = nil
+		m.freeSize = 0
+		m.corruptAry = nil
 
-		reloadBuf := m.writeContent
-		for i := m.writePos; i > 0; {
-			mmapData := reloadMMapData(reloadBuf)
-			i -= int(mmapData.GetSize())
-			m.mmapdataAry = append(m.mmapdataAry, mmapData)
+		if err := m.checkContent(); nil != err {
+			m.writePos = 0
+			return err
+		}
+
+		reloadBuf := m.writeContent[:m.writePos]
+		for len(reloadBuf) > 0 {
+			mmapData := reloadMMapData(m.dataHeadLen, reloadBuf)
+			if nil == mmapData {
+				return fmt.Errorf("%w offset:%v salvaged:%v",
+					ErrCorruptContent, m.writePos-len(reloadBuf), len(m.mmapdataAry))
+			}
 			reloadBuf = reloadBuf[mmapData.GetSize():]
+			// 已删除的数据块放入复用列表
+			if mmapData.IsDeleted() {
+				m.pushFreeSlot(mmapData)
+				continue
+			}
+			// 校验失败的数据块单独记录，不返回给业务层
+			if !mmapData.verify() {
+				m.corruptAry = append(m.corruptAry, mmapData)
+				continue
+			}
+			// 更新数据块的过程中崩溃，同一个key会有两份数据，保留seq大的一份
+			if old, ok := m.mmapdataIdx[string(mmapData.GetKey())]; ok {
+				m.replaceReloadData(old, mmapData)
+				continue
+			}
+			m.mmapdataAry = append(m.mmapdataAry, mmapData)
 			m.mmapdataIdx[string(mmapData.GetKey())] = mmapData
 		}
 	} else {
 		m.readPos = 0
 		m.setWritePos(0)
+		m.setHead(m.layout, m.dataSize)
+		m.dataHeadLen = mmapDataHeadLen
 
 		m.mmapdataIdx = make(map[string]*MMapData)
-		m.mmapdataAry = make([]*MMapData, 0, (len(m.buf)-mmapCacheHeadSize)/m.dataSize)
+		m.mmapdataAry = make([]*MMapData, 0, m.capacity())
+		m.freeSlots = nil
+		m.freeSize = 0
+		m.corruptAry = nil
 	}
+	return nil
 }
 
-func (m *MMapCache) recycle(template []byte) {
+// checkContent 校验文件头中与content相关的长度信息
+func (m *MMapCache) checkContent() error {
+	if m.writePos < 0 || m.writePos > len(m.writeContent) {
+		return fmt.Errorf("%w content.len:%v", ErrCorruptContent, m.writePos)
+	}
+	switch m.layout {
+	case LayoutFixed:
+		if m.dataSize < m.dataHeadLen {
+			return fmt.Errorf("%w datasize:%v", ErrCorruptContent, m.dataSize)
+		}
+	case LayoutVariable:
+		if m.dataSize <= 0 {
+			return fmt.Errorf("%w datasize:%v", ErrCorruptContent, m.dataSize)
+		}
+	default:
+		return fmt.Errorf("%w layout:%v", ErrCorruptContent, m.layout)
+	}
+	return nil
+}
+
+func (m *MMapCache) replaceReloadData(old, mmapData *MMapData) {
+	if int32(mmapData.getSeq()-old.getSeq()) < 0 {
+		mmapData.markDeleted(m.writeUint32Cache)
+		m.pushFreeSlot(mmapData)
+		return
+	}
+
+	for i, v := range m.mmapdataAry {
+		if v == old {
+			m.mmapdataAry[i] = mmapData
+			break
+		}
+	}
+	m.mmapdataIdx[string(mmapData.GetKey())] = mmapData
+	old.markDeleted(m.writeUint32Cache)
+	m.pushFreeSlot(old)
+}
+
+// recycle 清空缓存以便复用
+// 先将writePos归零，再将之前写入过的区域清零，避免上一个使用者的数据残留在文件中
+func (m *MMapCache) recycle() {
+	m.lock()
+	defer m.unlock()
+	used := m.writeContent[:m.writePos]
 	m.init(false)
+	for i := range used {
+		used[i] = mmapInitByte
+	}
 }
@@ -1,12 +1,16 @@
 package cache
 
 import (
+	"errors"
 	"fmt"
 	"mmapcache/byteio"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 var pwd string
@@ -28,7 +32,7 @@ func TestCreateMMapCache(t *testing.T) {
 	}
 	t.Logf("createMMapFile is ok %v", cachefile)
 
-	mmapCache, err := newMMapCache(cachefile, datasize, false)
+	mmapCache, err := newMMapCache(cachefile, LayoutFixed, datasize, false)
 	if nil != err {
 		t.Errorf("newMMapCache failed err:%v", err)
 		return
@@ -53,11 +57,23 @@ func TestMMapCacheRecyle(t *testing.T) {
 	t.Logf("cachefile:%v", cachefile)
 
 	createMMapFile(cachefile, template)
-	mmapCache, _ := newMMapCache(cachefile, datasize, false)
+	mmapCache, _ := newMMapCache(cachefile, LayoutFixed, datasize, false)
 	defer mmapCache.close(true)
 
+	for i := 0; i < 3; i++ {
+		key := fmt.Sprintf("key-%v", i)
+		mmapCache.WriteData(0x1, []byte(key), []byte(key), nil)
+	}
+	used := mmapCache.writeContent[:mmapCache.writePos]
+
 	// recyle
-	mmapCache.recycle(template)
+	mmapCache.recycle()
+	for i, b := range used {
+		if b != mmapInitByte {
+			t.Errorf("mmapcache.recycle content not zero pos:%v", i)
+			return
+		}
+	}
 	if mmapCache.getWritePos() != 0 {
 		t.Errorf("mmapcache.recycle buf.writepos:%v err", mmapCache.getWritePos())
 		return
@@ -78,7 +94,7 @@ func TestMMapCacheWrite(t *testing.T) {
 	t.Logf("cachefile:%v", cachefile)
 
 	createMMapFile(cachefile, template)
-	mmapCache, _ := newMMapCache(cachefile, datasize, false)
+	mmapCache, _ := newMMapCache(cachefile, LayoutFixed, datasize, false)
 	defer mmapCache.close(true)
 
 	writeKey := "HelloMMap"
@@ -173,7 +189,7 @@ func TestMMapCacheReload(t *testing.T) {
 	t.Logf("cachefile:%v", cachefile)
 
 	createMMapFile(cachefile, template)
-	mmapCache, _ := newMMapCache(cachefile, datasize, false)
+	mmapCache, _ := newMMapCache(cachefile, LayoutFixed, datasize, false)
 
 	writeCount := 50
 	for i := 0; i < writeCount; i++ {
@@ -187,7 +203,7 @@ func TestMMapCacheReload(t *testing.T) {
 	}
 	mmapCache.close(false)
 
-	mmapCache, _ = newMMapCache(cachefile, datasize, true)
+	mmapCache, _ = newMMapCache(cachefile, LayoutFixed, datasize, true)
 	defer mmapCache.close(true)
 	if len(mmapCache.mmapdataAry) != writeCount {
 		t.Errorf("mmapcache.data len:%v != %v", len(mmapCache.mmapdataAry), writeCount)
@@ -211,6 +227,798 @@ func TestMMapCacheReload(t *testing.T) {
 	}
 }
 
+func TestMMapCacheGet(t *testing.T) {
+	cachefile := fmt.Sprintf("%v/2.dat", pwd)
+	t.Logf("cachefile:%v", cachefile)
+
+	createMMapFile(cachefile, template)
+	mmapCache, _ := newMMapCache(cachefile, LayoutFixed, datasize, false)
+	defer mmapCache.close(true)
+
+	writeCount := 10
+	for i := 0; i < writeCount; i++ {
+		key := fmt.Sprintf("key-%v", i)
+		data := fmt.Sprintf("data-%v", i)
+		mmapCache.WriteData(uint16(i), []byte(data), []byte(key), i)
+	}
+	if mmapCache.Len() != writeCount {
+		t.Errorf("mmapcache.len:%v != %v", mmapCache.Len(), writeCount)
+		return
+	}
+
+	for i := 0; i < writeCount; i++ {
+		key := fmt.Sprintf("key-%v", i)
+		data := fmt.Sprintf("data-%v", i)
+		mmapData, ok := mmapCache.Get([]byte(key))
+		if !ok || string(mmapData.GetData()) != data || mmapData.GetVal() != i {
+			t.Errorf("mmapcache.get key:%v ok:%v", key, ok)
+			return
+		}
+		if !mmapCache.Has([]byte(key)) {
+			t.Errorf("mmapcache.has key:%v not found", key)
+			return
+		}
+	}
+
+	if _, ok := mmapCache.Get([]byte("key-none")); ok {
+		t.Errorf("mmapcache.get key-none found")
+		return
+	}
+	if mmapCache.Has([]byte("key-none")) {
+		t.Errorf("mmapcache.has key-none found")
+		return
+	}
+	t.Logf("mmapcache.get ok len:%v", mmapCache.Len())
+}
+
+func TestMMapCacheDelete(t *testing.T) {
+	cachefile := fmt.Sprintf("%v/3.dat", pwd)
+	t.Logf("cachefile:%v", cachefile)
+
+	createMMapFile(cachefile, template)
+	mmapCache, _ := newMMapCache(cachefile, LayoutFixed, datasize, false)
+
+	writeCount := 10
+	for i := 0; i < writeCount; i++ {
+		key := fmt.Sprintf("key-%v", i)
+		data := fmt.Sprintf("data-%v", i)
+		mmapCache.WriteData(uint16(i), []byte(data), []byte(key), nil)
+	}
+
+	// 删除偶数key
+	for i := 0; i < writeCount; i += 2 {
+		key := fmt.Sprintf("key-%v", i)
+		if !mmapCache.Delete([]byte(key)) {
+			t.Errorf("mmapcache.delete key:%v failed", key)
+			return
+		}
+	}
+	if mmapCache.Delete([]byte("key-0")) {
+		t.Errorf("mmapcache.delete key-0 twice")
+		return
+	}
+	if mmapCache.Has([]byte("key-0")) || mmapCache.Len() != writeCount/2 {
+		t.Errorf("mmapcache.delete len:%v != %v", mmapCache.Len(), writeCount/2)
+		return
+	}
+	mmapCache.close(false)
+
+	// reload后被删除的key不会再出现
+	mmapCache, _ = newMMapCache(cachefile, LayoutFixed, datasize, true)
+	defer mmapCache.close(true)
+	if mmapCache.Len() != writeCount/2 {
+		t.Errorf("mmapcache.delete reload len:%v != %v", mmapCache.Len(), writeCount/2)
+		return
+	}
+	for i, mmapData := range mmapCache.GetMMapDatas() {
+		key := fmt.Sprintf("key-%v", i*2+1)
+		data := fmt.Sprintf("data-%v", i*2+1)
+		if string(mmapData.GetKey()) != key || string(mmapData.GetData()) != data {
+			t.Errorf("mmapcache.delete reload idx:%v key:%v data:%v", i, string(mmapData.GetKey()), string(mmapData.GetData()))
+			return
+		}
+		if mmapData.GetSize() != uint32(datasize) || mmapData.IsDeleted() {
+			t.Errorf("mmapcache.delete reload idx:%v size:%v deleted:%v", i, mmapData.GetSize(), mmapData.IsDeleted())
+			return
+		}
+	}
+	t.Logf("mmapcache.delete reload ok len:%v", mmapCache.Len())
+}
+
+func TestMMapCacheSlotReuse(t *testing.T) {
+	cachefile := fmt.Sprintf("%v/4.dat", pwd)
+	t.Logf("cachefile:%v", cachefile)
+
+	createMMapFile(cachefile, template)
+	mmapCache, _ := newMMapCache(cachefile, LayoutFixed, datasize, false)
+
+	// 写满
+	writeCount := 0
+	for ; ; writeCount++ {
+		key := fmt.Sprintf("key-%v", writeCount)
+		n, _ := mmapCache.WriteData(0x1, []byte(key), []byte(key), nil)
+		if -1 == n {
+			break
+		}
+	}
+
+	// 删除后可以复用
+	deleteCount := 3
+	for i := 0; i < deleteCount; i++ {
+		mmapCache.Delete([]byte(fmt.Sprintf("key-%v", i)))
+	}
+	if mmapCache.GetFreeContentLen() < deleteCount*datasize {
+		t.Errorf("mmapcache.slotreuse free.len:%v < %v", mmapCache.GetFreeContentLen(), deleteCount*datasize)
+		return
+	}
+	writePos := mmapCache.writePos
+	for i := 0; i < deleteCount; i++ {
+		key := fmt.Sprintf("new-%v", i)
+		n, err := mmapCache.WriteData(0x2, []byte(key), []byte(key), nil)
+		if n != len(key) || nil != err {
+			t.Errorf("mmapcache.slotreuse write key:%v n:%v err:%v", key, n, err)
+			return
+		}
+	}
+	if n, _ := mmapCache.WriteData(0x2, []byte("full"), []byte("full"), nil); -1 != n {
+		t.Errorf("mmapcache.slotreuse write full n:%v", n)
+		return
+	}
+	if writePos != mmapCache.writePos || mmapCache.Len() != writeCount {
+		t.Errorf("mmapcache.slotreuse writepos:%v != %v len:%v != %v",
+			mmapCache.writePos, writePos, mmapCache.Len(), writeCount)
+		return
+	}
+
+	// reload时重建复用列表
+	mmapCache.Delete([]byte("new-0"))
+	mmapCache.close(false)
+	mmapCache, _ = newMMapCache(cachefile, LayoutFixed, datasize, true)
+	defer mmapCache.close(true)
+	if mmapCache.Len() != writeCount-1 || len(mmapCache.freeSlots) != 1 {
+		t.Errorf("mmapcache.slotreuse reload len:%v free:%v", mmapCache.Len(), len(mmapCache.freeSlots))
+		return
+	}
+	if mmapData, ok := mmapCache.Get([]byte("new-1")); !ok || string(mmapData.GetData()) != "new-1" {
+		t.Errorf("mmapcache.slotreuse reload new-1 ok:%v", ok)
+		return
+	}
+	if n, _ := mmapCache.WriteData(0x2, []byte("reuse"), []byte("reuse"), nil); n != len("reuse") {
+		t.Errorf("mmapcache.slotreuse reload write n:%v", n)
+		return
+	}
+	t.Logf("mmapcache.slotreuse ok count:%v", writeCount)
+}
+
+func TestMMapCacheVariableLayout(t *testing.T) {
+	cachefile := fmt.Sprintf("%v/5.dat", pwd)
+	t.Logf("cachefile:%v", cachefile)
+
+	align := 8
+	createMMapFile(cachefile, template)
+	mmapCache, _ := newMMapCache(cachefile, LayoutVariable, align, false)
+
+	// 大小不一的数据按实际长度分配
+	writeCount := 0
+	writeSize := 0
+	for ; ; writeCount++ {
+		key := fmt.Sprintf("key-%v", writeCount)
+		data := make([]byte, 100)
+		if writeCount%10 == 0 {
+			data = make([]byte, 6*1024)
+		}
+		n, err := mmapCache.WriteData(0x1, data, []byte(key), nil)
+		if nil != err {
+			t.Errorf("mmapcache.variable write err:%v", err)
+			return
+		}
+		if -1 == n {
+			break
+		}
+		mmapData, _ := mmapCache.Get([]byte(key))
+		if int(mmapData.GetSize())%align != 0 || int(mmapData.GetSize()) < mmapDataHeadLen+len(key)+len(data) {
+			t.Errorf("mmapcache.variable key:%v size:%v", key, mmapData.GetSize())
+			return
+		}
+		writeSize += int(mmapData.GetSize())
+	}
+	if writeSize != mmapCache.writePos || writeCount <= (cachesize-mmapCacheHeadSize)/datasize {
+		t.Errorf("mmapcache.variable writepos:%v != %v count:%v", mmapCache.writePos, writeSize, writeCount)
+		return
+	}
+
+	// 删除后的大数据块可以容纳小数据
+	mmapCache.Delete([]byte("key-0"))
+	if n, _ := mmapCache.WriteData(0x1, make([]byte, 100), []byte("small"), nil); n != 100 {
+		t.Errorf("mmapcache.variable reuse n:%v", n)
+		return
+	}
+	// keylen只有2byte，超长的key不能写入，否则reload时key与data的边界错位
+	if n, err := mmapCache.WriteData(0x1, []byte("data"), make([]byte, 70000), nil); 0 != n || ErrKeySizeOverflow != err {
+		t.Errorf("mmapcache.variable key overflow n:%v err:%v", n, err)
+		return
+	}
+	mmapCache.close(false)
+
+	// reload时按文件中记录的分配方式加载
+	mmapCache, _ = newMMapCache(cachefile, LayoutFixed, datasize, true)
+	defer mmapCache.close(true)
+	if mmapCache.Layout() != LayoutVariable || mmapCache.dataSize != align {
+		t.Errorf("mmapcache.variable reload layout:%v datasize:%v", mmapCache.Layout(), mmapCache.dataSize)
+		return
+	}
+	if mmapCache.Len() != writeCount {
+		t.Errorf("mmapcache.variable reload len:%v != %v", mmapCache.Len(), writeCount)
+		return
+	}
+	t.Logf("mmapcache.variable ok count:%v", writeCount)
+}
+
+func TestMMapCacheGrow(t *testing.T) {
+	cachefile := fmt.Sprintf("%v/6.dat", pwd)
+	t.Logf("cachefile:%v", cachefile)
+
+	// LayoutFixed 放不下时返回错误，旧数据保持不变
+	createMMapFile(cachefile, template)
+	mmapCache, _ := newMMapCache(cachefile, LayoutFixed, datasize, false)
+	mmapCache.WriteData(0x1, []byte("data"), []byte("key"), nil)
+	n, err := mmapCache.WriteData(0x1, make([]byte, datasize), []byte("key"), nil)
+	if 0 != n || ErrDataSizeOverflow != err {
+		t.Errorf("mmapcache.grow fixed n:%v err:%v", n, err)
+		return
+	}
+	if mmapData, _ := mmapCache.Get([]byte("key")); string(mmapData.GetData()) != "data" {
+		t.Errorf("mmapcache.grow fixed data:%v", string(mmapData.GetData()))
+		return
+	}
+	mmapCache.close(true)
+
+	// LayoutVariable 迁移到新的数据块
+	createMMapFile(cachefile, template)
+	mmapCache, _ = newMMapCache(cachefile, LayoutVariable, 8, false)
+	mmapCache.WriteData(0x1, []byte("data-0"), []byte("key-0"), 0)
+	mmapCache.WriteData(0x2, []byte("data-1"), []byte("key-1"), 1)
+	oldData, _ := mmapCache.Get([]byte("key-0"))
+	bigData := make([]byte, 1024)
+	for i := range bigData {
+		bigData[i] = byte(i)
+	}
+	n, err = mmapCache.WriteData(0x1, bigData, []byte("key-0"), 0)
+	if len(bigData) != n || nil != err {
+		t.Errorf("mmapcache.grow variable n:%v err:%v", n, err)
+		return
+	}
+	newData, _ := mmapCache.Get([]byte("key-0"))
+	if newData == oldData || !oldData.IsDeleted() || !byteio.BytesCmp(newData.GetData(), bigData) {
+		t.Errorf("mmapcache.grow variable relocate failed")
+		return
+	}
+	if newData.GetTag() != 0x1 || newData.GetVal() != 0 || mmapCache.GetMMapDatas()[0] != newData {
+		t.Errorf("mmapcache.grow variable tag:%v val:%v", newData.GetTag(), newData.GetVal())
+		return
+	}
+	if mmapData, _ := mmapCache.Get([]byte("key-1")); string(mmapData.GetData()) != "data-1" {
+		t.Errorf("mmapcache.grow variable neighbour data:%v", string(mmapData.GetData()))
+		return
+	}
+
+	// 文件空间不足时无法迁移
+	n, err = mmapCache.WriteData(0x1, make([]byte, cachesize), []byte("key-1"), 1)
+	if 0 != n || ErrDataSizeOverflow != err {
+		t.Errorf("mmapcache.grow variable full n:%v err:%v", n, err)
+		return
+	}
+	mmapCache.close(false)
+
+	mmapCache, _ = newMMapCache(cachefile, LayoutVariable, 8, true)
+	defer mmapCache.close(true)
+	if mmapCache.Len() != 2 || len(mmapCache.freeSlots) != 1 {
+		t.Errorf("mmapcache.grow reload len:%v", mmapCache.Len())
+		return
+	}
+	if mmapData, _ := mmapCache.Get([]byte("key-0")); !byteio.BytesCmp(mmapData.GetData(), bigData) {
+		t.Errorf("mmapcache.grow reload data err")
+		return
+	}
+	t.Logf("mmapcache.grow ok")
+}
+
+func TestMMapCacheChecksum(t *testing.T) {
+	cachefile := fmt.Sprintf("%v/7.dat", pwd)
+	t.Logf("cachefile:%v", cachefile)
+
+	createMMapFile(cachefile, template)
+	mmapCache, _ := newMMapCache(cachefile, LayoutFixed, datasize, false)
+	writeCount := 10
+	for i := 0; i < writeCount; i++ {
+		key := fmt.Sprintf("key-%v", i)
+		data := fmt.Sprintf("data-%v", i)
+		mmapCache.WriteData(uint16(i), []byte(data), []byte(key), nil)
+	}
+	if mmapCache.getVersion() != mmapCacheVersion {
+		t.Errorf("mmapcache.checksum version:%v", mmapCache.getVersion())
+		return
+	}
+
+	// 破坏一个数据块的data
+	mmapData, _ := mmapCache.Get([]byte("key-3"))
+	mmapData.GetData()[0] ^= 0xff
+	mmapCache.close(false)
+
+	mmapCache, _ = newMMapCache(cachefile, LayoutFixed, datasize, true)
+	defer mmapCache.close(true)
+	if mmapCache.Len() != writeCount-1 || len(mmapCache.GetCorruptMMapDatas()) != 1 {
+		t.Errorf("mmapcache.checksum reload len:%v corrupt:%v", mmapCache.Len(), len(mmapCache.GetCorruptMMapDatas()))
+		return
+	}
+	if mmapCache.Has([]byte("key-3")) || string(mmapCache.GetCorruptMMapDatas()[0].GetKey()) != "key-3" {
+		t.Errorf("mmapcache.checksum corrupt key-3 not found")
+		return
+	}
+	t.Logf("mmapcache.checksum ok")
+}
+
+func TestMMapCacheVersionV1(t *testing.T) {
+	cachefile := fmt.Sprintf("%v/8.dat", pwd)
+	t.Logf("cachefile:%v", cachefile)
+
+	// 模拟 version 1 的文件（数据块没有checksum）
+	createMMapFile(cachefile, template)
+	mmapCache, _ := newMMapCache(cachefile, LayoutFixed, datasize, false)
+	mmapCache.setVersion(mmapCacheVersionV1)
+	mmapCache.dataHeadLen = mmapDataHeadLenV1
+	writeCount := 10
+	for i := 0; i < writeCount; i++ {
+		key := fmt.Sprintf("key-%v", i)
+		data := fmt.Sprintf("data-%v", i)
+		mmapCache.WriteData(uint16(i), []byte(data), []byte(key), nil)
+	}
+	mmapCache.close(false)
+
+	mmapCache, _ = newMMapCache(cachefile, LayoutFixed, datasize, true)
+	defer mmapCache.close(true)
+	if mmapCache.Len() != writeCount || mmapCache.dataHeadLen != mmapDataHeadLenV1 {
+		t.Errorf("mmapcache.v1 reload len:%v headlen:%v", mmapCache.Len(), mmapCache.dataHeadLen)
+		return
+	}
+	for i, mmapData := range mmapCache.GetMMapDatas() {
+		if string(mmapData.GetData()) != fmt.Sprintf("data-%v", i) {
+			t.Errorf("mmapcache.v1 reload idx:%v data:%v", i, string(mmapData.GetData()))
+			return
+		}
+	}
+
+	// recycle后按当前version写入
+	mmapCache.recycle()
+	if mmapCache.getVersion() != mmapCacheVersion || mmapCache.dataHeadLen != mmapDataHeadLen {
+		t.Errorf("mmapcache.v1 recycle version:%v", mmapCache.getVersion())
+		return
+	}
+	t.Logf("mmapcache.v1 ok")
+}
+
+func TestMMapCacheFlush(t *testing.T) {
+	cachefile := fmt.Sprintf("%v/9.dat", pwd)
+	t.Logf("cachefile:%v", cachefile)
+
+	createMMapFile(cachefile, template)
+	mmapCache, _ := newMMapCache(cachefile, LayoutFixed, datasize, false)
+	defer mmapCache.close(true)
+
+	mmapCache.WriteData(0x1, []byte("data"), []byte("key"), nil)
+	if err := mmapCache.Flush(); nil != err {
+		t.Errorf("mmapcache.flush err:%v", err)
+		return
+	}
+	if err := mmapCache.FlushRange(mmapCacheHeadSize+100, datasize); nil != err {
+		t.Errorf("mmapcache.flushrange err:%v", err)
+		return
+	}
+	for _, off := range []int{-1, len(mmapCache.buf), len(mmapCache.buf) + 4096} {
+		if err := mmapCache.FlushRange(off, datasize); !errors.Is(err, ErrFlushRange) {
+			t.Errorf("mmapcache.flushrange off:%v err:%v", off, err)
+			return
+		}
+	}
+
+	// SyncEveryN
+	mmapCache.SetSyncPolicy(SyncPolicy{Mode: SyncEveryN, Writes: 3})
+	for i := 0; i < 4; i++ {
+		key := fmt.Sprintf("key-%v", i)
+		if _, err := mmapCache.WriteData(0x1, []byte(key), []byte(key), nil); nil != err {
+			t.Errorf("mmapcache.sync every.n err:%v", err)
+			return
+		}
+	}
+	if mmapCache.syncWrites != 1 {
+		t.Errorf("mmapcache.sync every.n writes:%v", mmapCache.syncWrites)
+		return
+	}
+
+	// SyncInterval
+	mmapCache.SetSyncPolicy(SyncPolicy{Mode: SyncInterval, Interval: time.Millisecond * 10})
+	mmapCache.WriteData(0x1, []byte("interval"), []byte("key"), nil)
+	mmapCache.WriteData(0x1, []byte("interval"), []byte("key"), nil)
+	if atomic.LoadInt32(&mmapCache.syncPending) != 1 {
+		t.Errorf("mmapcache.sync interval not pending")
+		return
+	}
+	<-time.After(time.Millisecond * 50)
+	if atomic.LoadInt32(&mmapCache.syncPending) != 0 {
+		t.Errorf("mmapcache.sync interval not flushed")
+		return
+	}
+
+	// ReloadMMapCache 没有文件，刷盘直接返回
+	reloadCache := ReloadMMapCache(mmapCache.GetWrittenData())
+	if err := reloadCache.Flush(); nil != err {
+		t.Errorf("mmapcache.flush memory err:%v", err)
+		return
+	}
+	t.Logf("mmapcache.flush ok")
+}
+
+func TestMMapCacheCommit(t *testing.T) {
+	cachefile := fmt.Sprintf("%v/10.dat", pwd)
+	t.Logf("cachefile:%v", cachefile)
+
+	createMMapFile(cachefile, template)
+	mmapCache, _ := newMMapCache(cachefile, LayoutFixed, datasize, false)
+	mmapCache.WriteData(0x1, []byte("x"), []byte("x"), nil)
+	mmapCache.WriteData(0x1, []byte("k-0"), []byte("k"), nil)
+	mmapCache.Delete([]byte("x"))
+
+	// 更新写入到复用的数据块（文件中位于旧数据块之前）
+	oldData, _ := mmapCache.Get([]byte("k"))
+	mmapCache.WriteData(0x1, []byte("k-1"), []byte("k"), nil)
+	newData, _ := mmapCache.Get([]byte("k"))
+	if newData.getSeq() != oldData.getSeq()+1 || !oldData.IsDeleted() {
+		t.Errorf("mmapcache.commit update seq:%v -> %v", oldData.getSeq(), newData.getSeq())
+		return
+	}
+
+	// 模拟删除旧数据块之前崩溃
+	oldData.commit(mmapCache.writeUint32Cache)
+
+	// 模拟写新key的过程中崩溃，数据块没有提交
+	newMMapData(mmapCache.dataHeadLen, uint32(datasize), 0x1, 0,
+		mmapCache.writeContent[mmapCache.writePos:], []byte("torn"), []byte("torn"), nil)
+	mmapCache.close(false)
+
+	mmapCache, _ = newMMapCache(cachefile, LayoutFixed, datasize, true)
+	defer mmapCache.close(true)
+	if mmapCache.Len() != 1 || mmapCache.Has([]byte("torn")) {
+		t.Errorf("mmapcache.commit reload len:%v", mmapCache.Len())
+		return
+	}
+	if mmapData, _ := mmapCache.Get([]byte("k")); string(mmapData.GetData()) != "k-1" {
+		t.Errorf("mmapcache.commit reload data:%v", string(mmapData.GetData()))
+		return
+	}
+	if len(mmapCache.freeSlots) != 1 || len(mmapCache.GetCorruptMMapDatas()) != 0 {
+		t.Errorf("mmapcache.commit reload free:%v corrupt:%v", len(mmapCache.freeSlots), len(mmapCache.GetCorruptMMapDatas()))
+		return
+	}
+
+	// 没有空闲数据块时无法更新，旧数据保持不变
+	for i := 0; ; i++ {
+		key := fmt.Sprintf("key-%v", i)
+		if n, _ := mmapCache.WriteData(0x1, []byte(key), []byte(key), nil); -1 == n {
+			break
+		}
+	}
+	if n, err := mmapCache.WriteData(0x1, []byte("k-2"), []byte("k"), nil); -1 != n || nil != err {
+		t.Errorf("mmapcache.commit full n:%v err:%v", n, err)
+		return
+	}
+	if mmapData, _ := mmapCache.Get([]byte("k")); string(mmapData.GetData()) != "k-1" {
+		t.Errorf("mmapcache.commit full data:%v", string(mmapData.GetData()))
+		return
+	}
+	t.Logf("mmapcache.commit ok")
+}
+
+func TestMMapCacheHead(t *testing.T) {
+	cachefile := fmt.Sprintf("%v/11.dat", pwd)
+	t.Logf("cachefile:%v", cachefile)
+
+	// 文件过小
+	createMMapFile(cachefile, make([]byte, 100))
+	if _, err := newMMapCache(cachefile, LayoutFixed, datasize, true); ErrBadHead != err {
+		t.Errorf("mmapcache.head small file err:%v", err)
+		return
+	}
+
+	createMMapFile(cachefile, template)
+	mmapCache, _ := newMMapCache(cachefile, LayoutFixed, datasize, false)
+	mmapCache.WriteData(0x1, []byte("data"), []byte("key"), nil)
+	if err := mmapCache.checkHead(); nil != err {
+		t.Errorf("mmapcache.head check err:%v", err)
+		return
+	}
+
+	// 未知的version
+	mmapCache.setVersion(mmapCacheVersion + 1)
+	mmapCache.close(false)
+	if _, err := newMMapCache(cachefile, LayoutFixed, datasize, true); ErrUnknownVersion != err {
+		t.Errorf("mmapcache.head unknown version err:%v", err)
+		return
+	}
+
+	// magic不匹配
+	mmapCache, _ = newMMapCache(cachefile, LayoutFixed, datasize, false)
+	mmapCache.WriteData(0x1, []byte("data"), []byte("key"), nil)
+	mmapCache.buf[mmapCacheHeadMagicPos] ^= 0xff
+	mmapCache.close(false)
+	if _, err := newMMapCache(cachefile, LayoutFixed, datasize, true); ErrBadHead != err {
+		t.Errorf("mmapcache.head bad magic err:%v", err)
+		return
+	}
+
+	// checksum不匹配
+	mmapCache, _ = newMMapCache(cachefile, LayoutFixed, datasize, false)
+	mmapCache.WriteData(0x1, []byte("data"), []byte("key"), nil)
+	byteio.Uint32ToBytes(uint32(datasize*2), mmapCache.buf[mmapCacheHeadDataSizePos:])
+	mmapCache.close(false)
+	if _, err := newMMapCache(cachefile, LayoutFixed, datasize, true); ErrBadHead != err {
+		t.Errorf("mmapcache.head bad checksum err:%v", err)
+		return
+	}
+	os.Remove(cachefile)
+	t.Logf("mmapcache.head ok")
+}
+
+func TestMMapCacheMigrate(t *testing.T) {
+	cachefile := fmt.Sprintf("%v/12.dat", pwd)
+	t.Logf("cachefile:%v", cachefile)
+
+	// 模拟 version 1 的文件
+	createMMapFile(cachefile, template)
+	mmapCache, _ := newMMapCache(cachefile, LayoutFixed, datasize, false)
+	mmapCache.setVersion(mmapCacheVersionV1)
+	mmapCache.dataHeadLen = mmapDataHeadLenV1
+	writeCount := 10
+	for i := 0; i < writeCount; i++ {
+		key := fmt.Sprintf("key-%v", i)
+		data := fmt.Sprintf("data-%v", i)
+		mmapCache.WriteData(uint16(i), []byte(data), []byte(key), nil)
+	}
+	mmapCache.SetStatus(0xab)
+	mmapCache.close(false)
+
+	mmapCache, _ = newMMapCache(cachefile, LayoutFixed, datasize, true)
+	mmapCache, err := migrateMMapCache(mmapCache, 0666)
+	if nil != err {
+		t.Errorf("mmapcache.migrate err:%v", err)
+		return
+	}
+	defer mmapCache.close(true)
+	if mmapCache.getVersion() != mmapCacheVersion || mmapCache.dataHeadLen != mmapDataHeadLen || nil != mmapCache.checkHead() {
+		t.Errorf("mmapcache.migrate version:%v headlen:%v", mmapCache.getVersion(), mmapCache.dataHeadLen)
+		return
+	}
+	if mmapCache.Len() != writeCount || mmapCache.GetStatus() != 0xab {
+		t.Errorf("mmapcache.migrate len:%v status:%v", mmapCache.Len(), mmapCache.GetStatus())
+		return
+	}
+	for i, mmapData := range mmapCache.GetMMapDatas() {
+		if string(mmapData.GetData()) != fmt.Sprintf("data-%v", i) || mmapData.GetTag() != uint16(i) {
+			t.Errorf("mmapcache.migrate idx:%v data:%v tag:%v", i, string(mmapData.GetData()), mmapData.GetTag())
+			return
+		}
+	}
+	if _, err := os.Stat(cachefile + mmapMigrateSuffix); nil == err {
+		t.Errorf("mmapcache.migrate tmp file exists")
+		return
+	}
+
+	// 有校验失败的数据块时拒绝升级，原文件不变
+	mmapCache.close(false)
+	createMMapFile(cachefile, template)
+	mmapCache, _ = newMMapCache(cachefile, LayoutFixed, datasize, false)
+	mmapCache.setVersion(mmapCacheVersionV2)
+	mmapCache.dataHeadLen = mmapDataHeadLenV2
+	for i := 0; i < 3; i++ {
+		key := fmt.Sprintf("key-%v", i)
+		mmapCache.WriteData(0x1, []byte(key), []byte(key), nil)
+	}
+	mmapData, _ := mmapCache.Get([]byte("key-1"))
+	mmapData.GetData()[0] ^= 0xff
+	mmapCache.close(false)
+	mmapCache, _ = newMMapCache(cachefile, LayoutFixed, datasize, true)
+	if _, err := migrateMMapCache(mmapCache, 0666); !errors.Is(err, ErrMigrateCorrupt) {
+		t.Errorf("mmapcache.migrate corrupt err:%v", err)
+		return
+	}
+	mmapCache.close(false)
+	mmapCache, _ = newMMapCache(cachefile, LayoutFixed, datasize, true)
+	if mmapCache.getVersion() != mmapCacheVersionV2 || 2 != mmapCache.Len() || 1 != len(mmapCache.GetCorruptMMapDatas()) {
+		t.Errorf("mmapcache.migrate corrupt file changed version:%v", mmapCache.getVersion())
+		return
+	}
+
+	// 接近datasize的数据块升级后放不下
+	mmapCache.close(false)
+	createMMapFile(cachefile, template)
+	mmapCache, _ = newMMapCache(cachefile, LayoutFixed, datasize, false)
+	mmapCache.setVersion(mmapCacheVersionV1)
+	mmapCache.dataHeadLen = mmapDataHeadLenV1
+	mmapCache.WriteData(0x1, make([]byte, datasize-mmapDataHeadLenV1-3), []byte("big"), nil)
+	mmapCache.close(false)
+	mmapCache, _ = newMMapCache(cachefile, LayoutFixed, datasize, true)
+	if _, err := migrateMMapCache(mmapCache, 0666); !errors.Is(err, ErrDataSizeOverflow) {
+		t.Errorf("mmapcache.migrate oversize err:%v", err)
+		return
+	}
+	mmapCache.close(false)
+	if _, err := os.Stat(cachefile + mmapMigrateSuffix); nil == err {
+		t.Errorf("mmapcache.migrate oversize tmp file exists")
+		return
+	}
+	t.Logf("mmapcache.migrate ok")
+}
+
+func TestMMapCacheReloadCorrupt(t *testing.T) {
+	cachefile := fmt.Sprintf("%v/13.dat", pwd)
+	t.Logf("cachefile:%v", cachefile)
+
+	writeCount := 10
+	prepare := func() *MMapCache {
+		createMMapFile(cachefile, template)
+		mmapCache, _ := newMMapCache(cachefile, LayoutFixed, datasize, false)
+		for i := 0; i < writeCount; i++ {
+			key := fmt.Sprintf("key-%v", i)
+			mmapCache.WriteData(0x1, []byte(key), []byte(key), nil)
+		}
+		// version 3 的文件头没有checksum，可以直接篡改
+		mmapCache.setVersion(mmapCacheVersionV3)
+		return mmapCache
+	}
+	defer os.Remove(cachefile)
+
+	// content.len 超出文件
+	mmapCache := prepare()
+	byteio.Uint32ToBytes(uint32(cachesize), mmapCache.buf)
+	mmapCache.close(false)
+	if _, err := newMMapCache(cachefile, LayoutFixed, datasize, true); !errors.Is(err, ErrCorruptContent) {
+		t.Errorf("mmapcache.reload corrupt content.len err:%v", err)
+		return
+	}
+
+	// datasize 为 0
+	mmapCache = prepare()
+	byteio.Uint32ToBytes(0, mmapCache.buf[mmapCacheHeadDataSizePos:])
+	mmapCache.close(false)
+	if _, err := newMMapCache(cachefile, LayoutFixed, datasize, true); !errors.Is(err, ErrCorruptContent) {
+		t.Errorf("mmapcache.reload corrupt datasize err:%v", err)
+		return
+	}
+
+	// 第4个数据块的size被破坏
+	mmapCache = prepare()
+	mmapData, _ := mmapCache.Get([]byte("key-3"))
+	byteio.Uint32ToBytes(uint32(cachesize*2), mmapData.buf)
+	chunkBuf := append([]byte{}, mmapCache.GetWrittenData()...)
+	mmapCache.close(false)
+	_, err := newMMapCache(cachefile, LayoutFixed, datasize, true)
+	if !errors.Is(err, ErrCorruptContent) || !strings.Contains(err.Error(), "salvaged:3") {
+		t.Errorf("mmapcache.reload corrupt record err:%v", err)
+		return
+	}
+	reloadCache := ReloadMMapCache(chunkBuf)
+	if reloadCache.Len() != 3 {
+		t.Errorf("mmapcache.reload corrupt memory len:%v", reloadCache.Len())
+		return
+	}
+
+	// data.used 被破坏的数据块可以跳过
+	mmapCache = prepare()
+	mmapData, _ = mmapCache.Get([]byte("key-5"))
+	byteio.Uint32ToBytes(uint32(cachesize), mmapData.buf[mmapDataHeadUsedPos:])
+	mmapCache.close(false)
+	mmapCache, err = newMMapCache(cachefile, LayoutFixed, datasize, true)
+	if nil != err || mmapCache.Len() != writeCount-1 || len(mmapCache.GetCorruptMMapDatas()) != 1 {
+		t.Errorf("mmapcache.reload corrupt used err:%v", err)
+		return
+	}
+	mmapCache.close(false)
+
+	if nil != ReloadMMapCache(make([]byte, 100)) {
+		t.Errorf("mmapcache.reload short buf not nil")
+		return
+	}
+	t.Logf("mmapcache.reload corrupt ok")
+}
+
+func TestMMapCacheUnmap(t *testing.T) {
+	cachefile := fmt.Sprintf("%v/14.dat", pwd)
+	t.Logf("cachefile:%v", cachefile)
+
+	live := LiveMappings()
+	createMMapFile(cachefile, template)
+	mmapCache, err := newMMapCache(cachefile, LayoutFixed, datasize, false)
+	if nil != err {
+		t.Errorf("mmapcache.unmap new err:%v", err)
+		return
+	}
+	if LiveMappings() != live+1 {
+		t.Errorf("mmapcache.unmap live:%v expect:%v", LiveMappings(), live+1)
+		return
+	}
+
+	mmapCache.close(true)
+	mmapCache.close(true)
+	if LiveMappings() != live {
+		t.Errorf("mmapcache.unmap live:%v expect:%v", LiveMappings(), live)
+		return
+	}
+	if nil != mmapCache.Flush() {
+		t.Errorf("mmapcache.unmap flush after close")
+		return
+	}
+	if _, err := os.Stat(cachefile); !os.IsNotExist(err) {
+		t.Errorf("mmapcache.unmap file not removed err:%v", err)
+		return
+	}
+	t.Logf("mmapcache.unmap ok")
+}
+
+func TestMMapCacheConcurrent(t *testing.T) {
+	cachefile := fmt.Sprintf("%v/15.dat", pwd)
+	t.Logf("cachefile:%v", cachefile)
+
+	createMMapFile(cachefile, template)
+	mmapCache, _ := newMMapCache(cachefile, LayoutFixed, 128, false)
+	defer mmapCache.close(true)
+	mmapCache.SetConcurrent(true)
+
+	writers, writeCount := 8, 50
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(2)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < writeCount; i++ {
+				key := []byte(fmt.Sprintf("key-%v-%v", w, i))
+				if n, err := mmapCache.WriteData(0x1, key, key, nil); nil != err || n < 0 {
+					t.Errorf("mmapcache.concurrent write n:%v err:%v", n, err)
+					return
+				}
+			}
+		}(w)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < writeCount; i++ {
+				for _, mmapData := range mmapCache.GetMMapDatas() {
+					mmapData.GetKey()
+				}
+				mmapCache.Len()
+				mmapCache.GetFreeContentLen()
+			}
+		}()
+	}
+	wg.Wait()
+	if mmapCache.Len() != writers*writeCount {
+		t.Errorf("mmapcache.concurrent len:%v", mmapCache.Len())
+		return
+	}
+
+	reloadCache := ReloadMMapCache(mmapCache.GetWrittenData())
+	if reloadCache.Len() != writers*writeCount {
+		t.Errorf("mmapcache.concurrent reload len:%v", reloadCache.Len())
+		return
+	}
+
+	// Release之后不能再写入
+	mmapCache.Release()
+	mmapCache.Release()
+	if _, err := mmapCache.WriteData(0x1, []byte("data"), []byte("key"), nil); ErrCacheReleased != err {
+		t.Errorf("mmapcache.concurrent write after release err:%v", err)
+		return
+	}
+	t.Logf("mmapcache.concurrent ok")
+}
+
 var mmapCacheBench *MMapCache
 var fileBench *os.File
 var fileCounter int
@@ -223,7 +1031,7 @@ func TestMMapCacheBenchPrepare(t *testing.T) {
 
 	cachefile := fmt.Sprintf("%v/b.dat", pwd)
 	createMMapFile(cachefile, template)
-	mmapCacheBench, _ = newMMapCache(cachefile, datasize, false)
+	mmapCacheBench, _ = newMMapCache(cachefile, LayoutFixed, datasize, false)
 
 	filePath := fmt.Sprintf("%v/bf.dat", pwd)
 	f, err := os.OpenFile(filePath, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
@@ -246,7 +1054,7 @@ func Benchmark_MMapcache_Write(b *testing.B) {
 	for i := 0; i < b.N; i++ {
 		n, _ := mmapCacheBench.WriteData(0x1, data, key, nil)
 		if -1 == n {
-			mmapCacheBench.recycle(template)
+			mmapCacheBench.recycle()
 			mmapCacheBench.WriteData(0x1, data, key, nil)
 		}
 	}
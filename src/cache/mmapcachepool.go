@@ -2,44 +2,87 @@ package cache
 
 import (
 	"container/list"
+	"context"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 // DefPoolMMapCache Init初始化完成后，得到的内存池对象
+// 兼容旧的使用方式，需要多个缓存池时使用NewPool
 var DefPoolMMapCache *PoolMMapCache
 
 const mmapInitByte byte = 0
 
 // PoolMMapCache 通过mmap方式对内存对象持久化缓存
 type PoolMMapCache struct {
-	dir            string
-	template       []byte
-	dataSize       int
-	pool           *list.List
-	recycleDur     time.Duration
-	allocator      chan *MMapCache
-	collector      chan *MMapCache
-	errorfuc       func(error)
-	loadFlag       bool
-	closedFlag     bool
-	allocCounter   uint64
+	// 原子操作的64位字段放在最前面，保证32位平台上的对齐
+	allocWaitCount uint64 // Alloc成功分配的次数
+	allocWaitTotal int64  // Alloc等待的总时长（ns）
+	allocWaitMax   int64  // Alloc等待的最大时长（ns）
+	allocCounter   uint64 // 以下指标由后台goroutine原子更新，DumpRuntime原子读取
 	collectCounter uint64
 	releaseCounter uint64
-	poolSize       int
-	wait           sync.WaitGroup
+	poolSize       int64
+	liveMappings   int64  // 此缓存池分配（以及reload）的MMapCache中尚未Unmap的映射数量
+	nameSeq        uint64 // 文件名的序号，跳过已存在的文件名时递增，不计入AllocCounter
+
+	dir           string
+	mmapSize      int
+	preallocMode  PreallocMode
+	template      []byte // 仅PreallocWrite时使用
+	layout        Layout
+	dataSize      int
+	prealloc      int
+	lowWatermark  int
+	highWatermark int
+	fileMode      os.FileMode
+	pool          *list.List
+	recycleDur    time.Duration
+	allocator     chan *MMapCache
+	collector     chan *MMapCache
+	errorfuc      func(error)
+	ready         chan struct{} // 初始化的预分配完成后关闭
+	syncPolicy    SyncPolicy
+	concurrent    bool
+	logger        Logger
+	wait          sync.WaitGroup
+
+	allocErr   chan error    // 缓存池为空且处于降级状态时，Alloc从这里得到错误
+	done       chan struct{} // Close时关闭，通知后台goroutine与阻塞的Alloc退出
+	closeOnce  sync.Once
+	stateMu    sync.Mutex    // 保护lastErr与syncPolicy
+	lastErr    error         // 最近一次分配文件失败的错误，成功后清空
+	initErr    error         // 初始化时无法预分配任何文件，ready关闭前写入
+	retryAt    time.Time     // 降级状态下，下一次重试分配文件的时间
+	retryDelay time.Duration // 降级状态下的重试间隔，每次失败翻倍
 }
 
+const (
+	mmapRetryMinDelay = time.Millisecond * 100
+	mmapRetryMaxDelay = time.Second * 10
+)
+
+var (
+	// ErrPoolDegraded 缓存池无法分配新的文件（例如磁盘已满），且池中已没有可用的文件
+	ErrPoolDegraded = errors.New("mmap cache pool degraded")
+	// ErrPoolClosed 缓存池已关闭
+	ErrPoolClosed = errors.New("mmap cache pool closed")
+)
+
 // InitMMapCachePool 初始化mmap的cache池
 // mmapsize 缓存文件大小
 // datasize 缓存数据块大小
 // prealloc 初始化缓存池时，会预先构建的缓存文件数量
 // errorfunc 当出现异常，会出发此函数异步抛出error
+// mmapsize、datasize、prealloc必须大于0，否则返回 ErrInvalidOptions
+// 需要其他配置（例如数据块分配方式）时使用 NewPool
 // reloadfunc 当本地有之前的缓存数据时，通过此函数处理已经缓存到本地的数据
 //            这批数据会初始化为MMapCache对象，但不会被添加到缓存池中（因为其中已经有数据，处于正在使用状态）
 // func(mmapCaches []*MMapCache) {
@@ -55,71 +98,225 @@ func InitMMapCachePool(
 	mmapsize int, datasize int, prealloc int,
 	errorfunc func(error),
 	reloadfunc func([]*MMapCache)) error {
-	os.MkdirAll(dir, os.ModePerm)
-	DefPoolMMapCache = &PoolMMapCache{
-		dir:        dir,
-		template:   createMMapTemplate(mmapsize),
-		dataSize:   datasize,
-		pool:       list.New(),
-		recycleDur: time.Second,
-		allocator:  make(chan *MMapCache),
-		collector:  make(chan *MMapCache),
-		errorfuc:   errorfunc,
-		loadFlag:   false,
-	}
-
-	reload := DefPoolMMapCache.reloadCache()
-	DefPoolMMapCache.wait.Add(1)
-	DefPoolMMapCache.mmapAllocLoop(prealloc)
-	for {
-		if DefPoolMMapCache.loadFlag == false {
-			<-time.After(time.Millisecond * 50)
-		} else {
-			break
+	// 旧接口没有"未设置"的语义，不使用NewPool的默认值
+	if mmapsize <= 0 || datasize <= 0 || prealloc <= 0 {
+		return fmt.Errorf("%w mmapsize:%v datasize:%v prealloc:%v", ErrInvalidOptions, mmapsize, datasize, prealloc)
+	}
+	pool, err := NewPool(Options{
+		Dir:        dir,
+		MMapSize:   mmapsize,
+		DataSize:   datasize,
+		Prealloc:   prealloc,
+		ErrorFunc:  errorfunc,
+		ReloadFunc: reloadfunc,
+	})
+	if nil != err {
+		return err
+	}
+	DefPoolMMapCache = pool
+	return nil
+}
+
+// NewPool 创建一个独立的mmap的cache池
+// 一个进程中可以创建多个缓存池，每个缓存池需要使用独立的目录
+// 从缓存池中分配（以及reload）的MMapCache，Release时会回收到各自的缓存池
+// 配置不合法时返回 ErrInvalidOptions
+func NewPool(opts Options) (*PoolMMapCache, error) {
+	opts = opts.withDefaults()
+	if err := opts.validate(); nil != err {
+		return nil, err
+	}
+	if err := os.MkdirAll(opts.Dir, os.ModePerm); nil != err {
+		return nil, err
+	}
+
+	pool := &PoolMMapCache{
+		dir:           opts.Dir,
+		mmapSize:      opts.MMapSize,
+		preallocMode:  opts.PreallocMode,
+		layout:        opts.Layout,
+		dataSize:      opts.DataSize,
+		prealloc:      opts.Prealloc,
+		lowWatermark:  opts.LowWatermark,
+		highWatermark: opts.HighWatermark,
+		fileMode:      opts.FileMode,
+		pool:          list.New(),
+		recycleDur:    opts.RecycleInterval,
+		allocator:     make(chan *MMapCache),
+		allocErr:      make(chan error),
+		done:          make(chan struct{}),
+		collector:     make(chan *MMapCache),
+		errorfuc:      opts.ErrorFunc,
+		ready:         make(chan struct{}),
+		syncPolicy:    opts.SyncPolicy,
+		concurrent:    opts.Concurrent,
+		logger:        opts.Logger,
+	}
+	if PreallocWrite == pool.preallocMode {
+		pool.template = createMMapTemplate(opts.MMapSize)
+	}
+
+	reload := pool.reloadCache()
+	pool.wait.Add(1)
+	pool.mmapAllocLoop()
+	<-pool.ready
+	if nil != pool.initErr {
+		for _, mmapCache := range reload {
+			mmapCache.close(false)
 		}
+		return nil, pool.initErr
 	}
 
-	reloadfunc(reload)
-	return nil
+	opts.ReloadFunc(reload)
+	return pool, nil
 }
 
 // Alloc 分配一个mmapcache
-func (m *PoolMMapCache) Alloc() *MMapCache {
-	return <-m.allocator
+// 缓存池为空且无法分配新的文件时，返回 ErrPoolDegraded
+// 缓存池已关闭时，返回 ErrPoolClosed
+func (m *PoolMMapCache) Alloc() (*MMapCache, error) {
+	return m.AllocContext(context.Background())
+}
+
+// AllocContext 分配一个mmapcache，ctx结束时返回 ctx.Err()
+func (m *PoolMMapCache) AllocContext(ctx context.Context) (*MMapCache, error) {
+	begin := time.Now()
+	select {
+	case mmcache := <-m.allocator:
+		m.recordAllocLatency(time.Since(begin))
+		mmcache.prepare(m.getSyncPolicy(), m.concurrent)
+		return mmcache, nil
+	case err := <-m.allocErr:
+		return nil, err
+	case <-m.done:
+		return nil, ErrPoolClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// TryAlloc 非阻塞的分配一个mmapcache，当前无法立即分配时返回false
+func (m *PoolMMapCache) TryAlloc() (*MMapCache, bool) {
+	select {
+	case mmcache := <-m.allocator:
+		m.recordAllocLatency(0)
+		mmcache.prepare(m.getSyncPolicy(), m.concurrent)
+		return mmcache, true
+	default:
+		return nil, false
+	}
+}
+
+// AllocLatency 获取Alloc成功分配的次数，以及等待时长的平均值与最大值
+func (m *PoolMMapCache) AllocLatency() (uint64, time.Duration, time.Duration) {
+	count := atomic.LoadUint64(&m.allocWaitCount)
+	if 0 == count {
+		return 0, 0, 0
+	}
+	total := atomic.LoadInt64(&m.allocWaitTotal)
+	return count, time.Duration(total / int64(count)), time.Duration(atomic.LoadInt64(&m.allocWaitMax))
+}
+
+func (m *PoolMMapCache) recordAllocLatency(d time.Duration) {
+	atomic.AddUint64(&m.allocWaitCount, 1)
+	atomic.AddInt64(&m.allocWaitTotal, int64(d))
+	for {
+		max := atomic.LoadInt64(&m.allocWaitMax)
+		if int64(d) <= max || atomic.CompareAndSwapInt64(&m.allocWaitMax, max, int64(d)) {
+			return
+		}
+	}
+}
+
+// Close 关闭缓存池
+// 停止后台goroutine，阻塞中的Alloc返回 ErrPoolClosed，池中空闲的文件会被关闭（文件保留，下次初始化时复用）
+// 已分配出去的MMapCache不受影响，其数据保留在文件中，下次初始化时通过reloadfunc重新加载
+// ctx 超时前后台goroutine没有退出时，返回 ctx.Err()
+func (m *PoolMMapCache) Close(ctx context.Context) error {
+	m.closeOnce.Do(func() {
+		close(m.done)
+	})
+
+	exited := make(chan struct{})
+	go func() {
+		m.wait.Wait()
+		close(exited)
+	}()
+	select {
+	case <-exited:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Degraded 缓存池是否处于降级状态（最近一次分配新的文件失败）
+// 降级状态下后台会按指数退避重试，分配成功后恢复
+func (m *PoolMMapCache) Degraded() bool {
+	return nil != m.getLastErr()
+}
+
+func (m *PoolMMapCache) getSyncPolicy() SyncPolicy {
+	m.stateMu.Lock()
+	defer m.stateMu.Unlock()
+	return m.syncPolicy
+}
+
+func (m *PoolMMapCache) getLastErr() error {
+	m.stateMu.Lock()
+	defer m.stateMu.Unlock()
+	return m.lastErr
+}
+
+func (m *PoolMMapCache) setLastErr(err error) {
+	m.stateMu.Lock()
+	defer m.stateMu.Unlock()
+	m.lastErr = err
 }
 
 // Collect 回收一个mmapcache到缓存池
+// 缓存池已关闭时，mmcache会被清空后关闭，文件保留，下次初始化时复用
 func (m *PoolMMapCache) Collect(mmcache *MMapCache) {
-	m.collector <- mmcache
+	select {
+	case m.collector <- mmcache:
+	case <-m.done:
+		mmcache.recycle()
+		mmcache.close(false)
+	}
 }
 
 // DumpRuntime 获取缓存池当前的数据指标
 // AllocCounter, CollectCounter, ReleaseCounter, PoolSize
 func (m *PoolMMapCache) DumpRuntime() (uint64, uint64, uint64, int) {
-	return m.allocCounter, m.collectCounter, m.releaseCounter, m.poolSize
+	return atomic.LoadUint64(&m.allocCounter),
+		atomic.LoadUint64(&m.collectCounter),
+		atomic.LoadUint64(&m.releaseCounter),
+		int(atomic.LoadInt64(&m.poolSize))
 }
 
-func createMMapTemplate(size int) []byte {
-	template := make([]byte, size)
-	for index := 0; index < size; index++ {
-		template[index] = mmapInitByte
-	}
-	return template
+// LiveMappings 获取此缓存池分配（以及reload）的MMapCache中尚未Unmap的映射数量
+// 缓存池Close、分配出的MMapCache都Release之后应归零，有多个缓存池时用于定位映射泄漏的缓存池
+func (m *PoolMMapCache) LiveMappings() int64 {
+	return atomic.LoadInt64(&m.liveMappings)
 }
 
-func createMMapFile(file string, template []byte) error {
-	return ioutil.WriteFile(file, template, 0666)
+func (m *PoolMMapCache) logf(format string, v ...interface{}) {
+	if nil != m.logger {
+		m.logger.Printf(format, v...)
+	}
 }
 
+// makeCacheFileName 生成新的缓存文件名
+// 同一秒内重启时文件名可能与reload的文件相同，跳过已存在的文件，避免覆盖其中的数据
 func (m *PoolMMapCache) makeCacheFileName() string {
-	fileName := fmt.Sprintf("%v_%v", uint32(time.Now().Unix()), m.allocCounter)
-	m.allocCounter++
-	return path.Join(m.dir, fmt.Sprintf("%v.cachedat", fileName))
-}
-
-func (m *PoolMMapCache) close() {
-	m.closedFlag = true
-	m.wait.Wait()
+	atomic.AddUint64(&m.allocCounter, 1)
+	for {
+		fileName := fmt.Sprintf("%v_%v", uint32(time.Now().Unix()), atomic.AddUint64(&m.nameSeq, 1)-1)
+		filePath := path.Join(m.dir, fmt.Sprintf("%v.cachedat", fileName))
+		if _, err := os.Stat(filePath); nil != err {
+			return filePath
+		}
+	}
 }
 
 func (m *PoolMMapCache) reloadCache() []*MMapCache {
@@ -134,17 +331,57 @@ func (m *PoolMMapCache) reloadCache() []*MMapCache {
 			continue
 		}
 
+		// 升级过程中崩溃残留的临时文件
+		if strings.HasSuffix(fi.Name(), ".cachedat"+mmapMigrateSuffix) {
+			os.Remove(path.Join(m.dir, fi.Name()))
+			continue
+		}
+
 		ok := strings.HasSuffix(fi.Name(), ".cachedat")
 		if ok {
 			filePath := path.Join(m.dir, fi.Name())
 
-			mmapCache, err := newMMapCache(filePath, m.dataSize, true)
+			mmapCache, err := newMMapCache(filePath, m.layout, m.dataSize, true)
 			// 数据没发加载，移动为.err文件，待分析
 			if nil != err {
 				os.Rename(filePath, fmt.Sprintf("%v.err", filePath))
+				m.logf("mmap cache %v quarantined err:%v", filePath, err)
+				m.errorfuc(fmt.Errorf("mmap cache %v reload err:%v", filePath, err))
 				continue
 			}
 
+			// 校验失败的数据块通过errorfunc抛出，不会交给业务层
+			if corrupt := mmapCache.GetCorruptMMapDatas(); len(corrupt) > 0 {
+				m.errorfuc(fmt.Errorf("mmap cache %v corrupt records:%v", filePath, len(corrupt)))
+			}
+
+			// 旧version的文件升级到当前version，升级失败时仍按旧version加载
+			if mmapCache.getWritePos() > 0 && mmapCache.getVersion() < mmapCacheVersion {
+				migrated, err := migrateMMapCache(mmapCache, m.fileMode)
+				if errors.Is(err, ErrMigrateCorrupt) {
+					// 升级会丢弃校验失败的数据块，保留原文件待分析
+					mmapCache.close(false)
+					os.Rename(filePath, fmt.Sprintf("%v.err", filePath))
+					m.logf("mmap cache %v quarantined err:%v", filePath, err)
+					m.errorfuc(fmt.Errorf("mmap cache %v migrate err:%v", filePath, err))
+					continue
+				} else if errors.Is(err, ErrMigrateReopen) {
+					// 原MMapCache已关闭，跳过此文件，已升级的文件下次初始化时再加载
+					m.logf("mmap cache %v skipped err:%v", filePath, err)
+					m.errorfuc(fmt.Errorf("mmap cache %v migrate err:%v", filePath, err))
+					continue
+				} else if nil != err {
+					m.errorfuc(fmt.Errorf("mmap cache %v migrate err:%v", filePath, err))
+				} else {
+					m.logf("mmap cache %v migrated to version:%v", filePath, mmapCacheVersion)
+					mmapCache = migrated
+				}
+			}
+
+			mmapCache.pool = m
+			atomic.AddInt64(&m.liveMappings, 1)
+			mmapCache.prepare(m.getSyncPolicy(), m.concurrent)
+
 			// 有数据，加入到reload队列抛给业务层自行处理
 			if mmapCache.getWritePos() > 0 {
 				reloadMMapCaches = append(reloadMMapCaches, mmapCache)
@@ -152,7 +389,7 @@ func (m *PoolMMapCache) reloadCache() []*MMapCache {
 			}
 
 			// 没有数据，判断一下文件大小是否一样，不一样就删了
-			if int(fi.Size()) != len(m.template) {
+			if int(fi.Size()) != m.mmapSize {
 				mmapCache.close(true)
 				continue
 			}
@@ -164,91 +401,125 @@ func (m *PoolMMapCache) reloadCache() []*MMapCache {
 	return reloadMMapCaches
 }
 
-func (m *PoolMMapCache) preAllocMMapCache() *MMapCache {
+func (m *PoolMMapCache) preAllocMMapCache() (*MMapCache, error) {
 	filePath := m.makeCacheFileName()
-
-	createFlag := false
-	fi, _ := os.Stat(filePath)
-	if nil != fi {
-		if int(fi.Size()) < len(m.template) {
-			os.Remove(filePath)
-			createFlag = true
-		}
-	} else {
-		createFlag = true
+	err := createMMapFileSize(filePath, m.mmapSize, m.template, m.fileMode, m.preallocMode)
+	if nil != err {
+		os.Remove(filePath)
+		return nil, err
 	}
 
-	if createFlag {
-		err := createMMapFile(filePath, m.template)
-		if nil != err {
-			m.errorfuc(err)
-			os.Exit(0)
-		}
+	mmapCache, err := newMMapCache(filePath, m.layout, m.dataSize, false)
+	if nil != err {
+		os.Remove(filePath)
+		return nil, err
 	}
+	mmapCache.pool = m
+	atomic.AddInt64(&m.liveMappings, 1)
+	return mmapCache, nil
+}
 
-	mmapCache, err := newMMapCache(filePath, m.dataSize, false)
+// refill 分配一个新的文件到缓存池，失败时进入降级状态并推迟下一次重试
+func (m *PoolMMapCache) refill() error {
+	mmapCache, err := m.preAllocMMapCache()
 	if nil != err {
+		if m.retryDelay < mmapRetryMinDelay {
+			m.retryDelay = mmapRetryMinDelay
+		} else if m.retryDelay *= 2; m.retryDelay > mmapRetryMaxDelay {
+			m.retryDelay = mmapRetryMaxDelay
+		}
+		m.retryAt = time.Now().Add(m.retryDelay)
+		m.setLastErr(err)
+		m.logf("mmap cache pool alloc file err:%v retry after:%v", err, m.retryDelay)
 		m.errorfuc(err)
-		os.Exit(0)
+		return err
+	}
+
+	if m.retryDelay > 0 {
+		m.retryDelay = 0
+		m.setLastErr(nil)
+		m.logf("mmap cache pool recovered")
 	}
-	return mmapCache
+	m.pool.PushBack(mmapCache)
+	return nil
 }
 
-func (m *PoolMMapCache) mmapAllocLoop(cnt int) {
+func (m *PoolMMapCache) mmapAllocLoop() {
 	go func() {
 		for {
-			if m.pool.Len() < cnt {
-				m.pool.PushBack(m.preAllocMMapCache())
+			if m.pool.Len() < m.prealloc {
+				if err := m.refill(); nil != err {
+					break
+				}
 			} else {
 				break
 			}
 		}
-		m.loadFlag = true
+		// 一个文件都没有，初始化失败
+		if 0 == m.pool.Len() {
+			m.initErr = m.getLastErr()
+			close(m.ready)
+			m.wait.Done()
+			return
+		}
+		close(m.ready)
 
 		for {
-			if m.closedFlag {
-				for {
-					if m.pool.Len() == 0 {
-						break
-					}
-					e := m.pool.Front()
-					e.Value.(*MMapCache).close(false)
-					m.pool.Remove(e)
+			wait := m.recycleDur
+			if m.pool.Len() < m.lowWatermark {
+				if now := time.Now(); !now.Before(m.retryAt) {
+					m.refill()
+				} else if d := m.retryAt.Sub(now); d < wait {
+					wait = d
 				}
-				break
 			}
 
-			if m.pool.Len() < cnt/2 {
-				m.pool.PushBack(m.preAllocMMapCache())
-			}
+			atomic.StoreInt64(&m.poolSize, int64(m.pool.Len()))
 
-			m.poolSize = m.pool.Len()
+			// 缓存池为空时不能分配，降级状态下直接返回错误
+			var allocator chan *MMapCache
+			var allocCache *MMapCache
+			var allocErr chan error
+			var err error
 			e := m.pool.Front()
+			if nil != e {
+				allocator, allocCache = m.allocator, e.Value.(*MMapCache)
+			} else if err = m.getLastErr(); nil != err {
+				allocErr, err = m.allocErr, fmt.Errorf("%w: %v", ErrPoolDegraded, err)
+			}
 
 			select {
 			case b := <-m.collector:
-				if m.pool.Len() < cnt*2 {
-					b.recycle(m.template)
+				if m.pool.Len() < m.highWatermark {
+					b.recycle()
 					m.pool.PushBack(b)
-					m.collectCounter++
+					atomic.AddUint64(&m.collectCounter, 1)
 				} else {
 					b.close(true)
 				}
-			case m.allocator <- e.Value.(*MMapCache):
+			case allocator <- allocCache:
 				m.pool.Remove(e)
-			case <-time.After(m.recycleDur):
-				if m.pool.Len() > cnt {
-					for i := 0; i < 10 && m.pool.Len() > cnt; i++ {
+			case allocErr <- err:
+			case <-m.done:
+				for e := m.pool.Front(); nil != e; e = m.pool.Front() {
+					e.Value.(*MMapCache).close(false)
+					m.pool.Remove(e)
+				}
+				atomic.StoreInt64(&m.poolSize, 0)
+				m.wait.Done()
+				return
+			case <-time.After(wait):
+				if m.pool.Len() > m.prealloc {
+					for i := 0; i < 10 && m.pool.Len() > m.prealloc; i++ {
 						e := m.pool.Back()
 						e.Value.(*MMapCache).close(true)
 						m.pool.Remove(e)
-						m.releaseCounter++
+						atomic.AddUint64(&m.releaseCounter, 1)
 					}
 				} else {
 					break
 				}
 			}
 		}
-		m.wait.Done()
 	}()
 }
@@ -1,12 +1,17 @@
 package cache
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path"
 	"path/filepath"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 var poolpwd string
@@ -14,11 +19,22 @@ var poolcachesize = 1024 * 1024 * 1
 var pooldatasize = 1024 * 8
 var poolcnt = 100
 
+// poolTestDir 返回测试使用的缓存池目录，并清理上一次运行残留的文件
+func poolTestDir(name string) string {
+	dir := path.Join(poolpwd, name)
+	os.RemoveAll(dir)
+	return dir
+}
+
 func TestPoolMMapCache(t *testing.T) {
 	poolpwd, _ = filepath.Abs(filepath.Dir(os.Args[0]))
 	ioutil.WriteFile(
 		path.Join(poolpwd, "x.cachedat.err"),
 		make([]byte, poolcachesize), 0666)
+	// 损坏的缓存文件会被移动为.err文件，不影响初始化
+	corrupt := make([]byte, poolcachesize)
+	corrupt[0], corrupt[mmapCacheHeadVersionPos+1] = 0xff, byte(mmapCacheVersionV3)
+	ioutil.WriteFile(path.Join(poolpwd, "y.cachedat"), corrupt, 0666)
 
 	InitMMapCachePool(
 		poolpwd, poolcachesize, pooldatasize, poolcnt,
@@ -27,9 +43,17 @@ func TestPoolMMapCache(t *testing.T) {
 		},
 		func(mmapCaches []*MMapCache) {
 		})
+	if _, err := os.Stat(path.Join(poolpwd, "y.cachedat.err")); nil != err {
+		t.Errorf("mmapcache.pool corrupt file not quarantined err:%v", err)
+		return
+	}
 
 	for index := 0; index < 10; index++ {
-		mmapCache := DefPoolMMapCache.Alloc()
+		mmapCache, err := DefPoolMMapCache.Alloc()
+		if nil != err {
+			t.Errorf("alloc mmapcache err:%v", err)
+			return
+		}
 		t.Logf("alloc mmapcache %p file:%v", mmapCache, mmapCache.path)
 		key := []byte(fmt.Sprintf("key-%v", index))
 		data := []byte(fmt.Sprintf("data-%v", index))
@@ -37,7 +61,7 @@ func TestPoolMMapCache(t *testing.T) {
 		mmapCache.WriteData(uint16(index), data, key, nil)
 		mmapCache.close(false)
 	}
-	DefPoolMMapCache.close()
+	DefPoolMMapCache.Close(context.Background())
 	t.Logf("mmapcache.pool closed")
 
 	InitMMapCachePool(
@@ -59,3 +83,810 @@ func TestPoolMMapCache(t *testing.T) {
 			}
 		})
 }
+
+func TestNewPool(t *testing.T) {
+	newPool := func(name string, mmapsize, datasize int) *PoolMMapCache {
+		pool, err := NewPool(Options{
+			Dir:      poolTestDir(name),
+			MMapSize: mmapsize,
+			DataSize: datasize,
+			Prealloc: 4,
+			ErrorFunc: func(err error) {
+				fmt.Printf("poolmmapcache.%v err:%v\n", name, err)
+			},
+			ReloadFunc: func(mmapCaches []*MMapCache) {},
+		})
+		if nil != err {
+			t.Fatalf("newpool %v err:%v", name, err)
+		}
+		return pool
+	}
+
+	orders := newPool("orders", 1024*64, 1024)
+	defer orders.Close(context.Background())
+	events := newPool("events", 1024*128, 256)
+	defer events.Close(context.Background())
+
+	ordersCache, _ := orders.Alloc()
+	eventsCache, _ := events.Alloc()
+	if len(ordersCache.buf) != 1024*64 || ordersCache.dataSize != 1024 || ordersCache.pool != orders {
+		t.Errorf("newpool orders size:%v datasize:%v", len(ordersCache.buf), ordersCache.dataSize)
+		return
+	}
+	if len(eventsCache.buf) != 1024*128 || eventsCache.dataSize != 256 || eventsCache.pool != events {
+		t.Errorf("newpool events size:%v datasize:%v", len(eventsCache.buf), eventsCache.dataSize)
+		return
+	}
+	if path.Dir(ordersCache.Path()) != path.Join(poolpwd, "orders") {
+		t.Errorf("newpool orders path:%v", ordersCache.Path())
+		return
+	}
+
+	// Release回收到各自的缓存池
+	ordersCache.Release()
+	eventsCache.Release()
+	for i := 0; i < 100; i++ {
+		_, ordersCollect, _, _ := orders.DumpRuntime()
+		_, eventsCollect, _, _ := events.DumpRuntime()
+		if 1 == ordersCollect && 1 == eventsCollect {
+			t.Logf("newpool ok")
+			return
+		}
+		<-time.After(time.Millisecond * 10)
+	}
+	t.Errorf("newpool collect failed")
+}
+
+func TestPoolFileName(t *testing.T) {
+	dir := poolTestDir("filename")
+	os.MkdirAll(dir, os.ModePerm)
+
+	// 同一秒内重启，reload的文件与新分配的文件同名时不能被覆盖
+	now := uint32(time.Now().Unix())
+	for _, sec := range []uint32{now, now + 1} {
+		cachefile := path.Join(dir, fmt.Sprintf("%v_0.cachedat", sec))
+		createMMapFile(cachefile, make([]byte, 1024*16))
+		mmapCache, err := newMMapCache(cachefile, LayoutFixed, 1024, false)
+		if nil != err {
+			t.Errorf("filename create %v err:%v", cachefile, err)
+			return
+		}
+		mmapCache.WriteData(0x1, []byte("data"), []byte("key"), nil)
+		mmapCache.close(false)
+	}
+
+	var reloaded []*MMapCache
+	pool, err := NewPool(Options{
+		Dir: dir, MMapSize: 1024 * 16, DataSize: 1024, Prealloc: 2,
+		SyncPolicy: SyncPolicy{Mode: SyncEveryWrite}, Concurrent: true,
+		ReloadFunc: func(mmapCaches []*MMapCache) { reloaded = mmapCaches },
+	})
+	if nil != err {
+		t.Errorf("filename newpool err:%v", err)
+		return
+	}
+	defer pool.Close(context.Background())
+	if 2 != len(reloaded) {
+		t.Errorf("filename reloaded:%v", len(reloaded))
+		return
+	}
+	for _, mmapCache := range reloaded {
+		// reload得到的MMapCache同样使用缓存池的刷盘策略与并发模式
+		if SyncEveryWrite != mmapCache.syncPolicy.Mode || !mmapCache.concurrent {
+			t.Errorf("filename %v reload sync:%v concurrent:%v", mmapCache.Path(), mmapCache.syncPolicy.Mode, mmapCache.concurrent)
+			return
+		}
+		if datas := mmapCache.GetMMapDatas(); 1 != len(datas) || "data" != string(datas[0].GetData()) {
+			t.Errorf("filename %v overwritten datas:%v", mmapCache.Path(), len(datas))
+			return
+		}
+		mmapCache.Release()
+	}
+	if allocCounter, _, _, _ := pool.DumpRuntime(); 2 != allocCounter {
+		t.Errorf("filename alloc counter:%v", allocCounter)
+		return
+	}
+	t.Logf("filename ok")
+}
+
+func TestPoolOptions(t *testing.T) {
+	dir := poolTestDir("options")
+	invalids := []Options{
+		{},
+		{Dir: dir, MMapSize: mmapCacheHeadSize},
+		{Dir: dir, MMapSize: 1024 * 64, DataSize: 1024 * 64},
+		{Dir: dir, DataSize: mmapDataHeadLen},
+		{Dir: dir, Layout: LayoutVariable, DataSize: -1},
+		{Dir: dir, Layout: Layout(9)},
+		{Dir: dir, Prealloc: -1},
+		{Dir: dir, Prealloc: 4, LowWatermark: 5},
+		{Dir: dir, Prealloc: 4, HighWatermark: 3},
+		{Dir: dir, SyncPolicy: SyncPolicy{Mode: SyncEveryN}},
+		{Dir: dir, SyncPolicy: SyncPolicy{Mode: SyncInterval}},
+		{Dir: dir, PreallocMode: PreallocMode(9)},
+	}
+	for i, opts := range invalids {
+		if _, err := NewPool(opts); !errors.Is(err, ErrInvalidOptions) {
+			t.Errorf("pool.options idx:%v opts:%+v err:%v", i, opts, err)
+			return
+		}
+	}
+	if err := InitMMapCachePool(dir, 1024, 1024, 1, nil, nil); !errors.Is(err, ErrInvalidOptions) {
+		t.Errorf("pool.options init err:%v", err)
+		return
+	}
+	for _, args := range [][3]int{{0, 1024, 1}, {1024 * 16, 0, 1}, {1024 * 16, 1024, 0}, {1024 * 16, -1, 1}} {
+		if err := InitMMapCachePool(dir, args[0], args[1], args[2], nil, nil); !errors.Is(err, ErrInvalidOptions) {
+			t.Errorf("pool.options init args:%v err:%v", args, err)
+			return
+		}
+	}
+
+	// 默认值
+	opts := Options{Dir: dir, Prealloc: 1}.withDefaults()
+	if nil != opts.validate() || opts.MMapSize != 1024*1024 || opts.LowWatermark != 1 || opts.HighWatermark != 2 {
+		t.Errorf("pool.options defaults:%+v", opts)
+		return
+	}
+	if opts := (Options{Dir: dir, Layout: LayoutVariable}).withDefaults(); opts.DataSize != mmapDataAlign {
+		t.Errorf("pool.options variable datasize:%v", opts.DataSize)
+		return
+	}
+
+	pool, err := NewPool(Options{Dir: dir, MMapSize: 1024 * 16, DataSize: 1024, Prealloc: 1, FileMode: 0600})
+	if nil != err {
+		t.Errorf("pool.options newpool err:%v", err)
+		return
+	}
+	defer pool.Close(context.Background())
+	mmapCache, _ := pool.Alloc()
+	fi, _ := os.Stat(mmapCache.Path())
+	if fi.Mode().Perm()&0077 != 0 {
+		t.Errorf("pool.options filemode:%v", fi.Mode())
+		return
+	}
+	t.Logf("pool.options ok")
+}
+
+func TestPoolDegraded(t *testing.T) {
+	dir := poolTestDir("degraded")
+	var errCount int32
+	pool, err := NewPool(Options{
+		Dir: dir, MMapSize: 1024 * 16, DataSize: 1024, Prealloc: 2, HighWatermark: 2,
+		RecycleInterval: time.Millisecond * 10,
+		ErrorFunc: func(err error) {
+			atomic.AddInt32(&errCount, 1)
+		},
+	})
+	if nil != err {
+		t.Errorf("pool.degraded newpool err:%v", err)
+		return
+	}
+	defer pool.Close(context.Background())
+
+	// 目录被替换为普通文件，无法再创建缓存文件
+	os.RemoveAll(dir)
+	ioutil.WriteFile(dir, nil, 0666)
+	var mmapCaches []*MMapCache
+	for {
+		mmapCache, err := pool.Alloc()
+		if nil != err {
+			if !errors.Is(err, ErrPoolDegraded) {
+				t.Errorf("pool.degraded alloc err:%v", err)
+				return
+			}
+			break
+		}
+		mmapCaches = append(mmapCaches, mmapCache)
+	}
+	if !pool.Degraded() || atomic.LoadInt32(&errCount) == 0 {
+		t.Errorf("pool.degraded not degraded allocs:%v", len(mmapCaches))
+		return
+	}
+	t.Logf("pool.degraded allocs:%v errs:%v", len(mmapCaches), atomic.LoadInt32(&errCount))
+
+	// 恢复后重新可以分配
+	os.Remove(dir)
+	os.MkdirAll(dir, os.ModePerm)
+	for i := 0; i < 100 && pool.Degraded(); i++ {
+		<-time.After(time.Millisecond * 20)
+	}
+	if pool.Degraded() {
+		t.Errorf("pool.degraded not recovered")
+		return
+	}
+	if _, err := pool.Alloc(); nil != err {
+		t.Errorf("pool.degraded recovered alloc err:%v", err)
+		return
+	}
+	t.Logf("pool.degraded ok")
+}
+
+func TestPoolClose(t *testing.T) {
+	dir := poolTestDir("close")
+	opts := Options{
+		Dir: dir, MMapSize: 1024 * 16, DataSize: 1024, Prealloc: 2,
+		RecycleInterval: time.Minute,
+	}
+	pool, err := NewPool(opts)
+	if nil != err {
+		t.Errorf("pool.close newpool err:%v", err)
+		return
+	}
+	inuse, _ := pool.Alloc()
+	inuse.WriteData(0x1, []byte("data"), []byte("key"), nil)
+	released, _ := pool.Alloc()
+	released.WriteData(0x1, []byte("data"), []byte("key"), nil)
+
+	// 不需要等待RecycleInterval
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	begin := time.Now()
+	if err := pool.Close(ctx); nil != err || time.Since(begin) > time.Second/2 {
+		t.Errorf("pool.close err:%v cost:%v", err, time.Since(begin))
+		return
+	}
+	if err := pool.Close(ctx); nil != err {
+		t.Errorf("pool.close twice err:%v", err)
+		return
+	}
+	if _, err := pool.Alloc(); ErrPoolClosed != err {
+		t.Errorf("pool.close alloc err:%v", err)
+		return
+	}
+	released.Release()
+	// 只剩下使用中的文件没有Unmap
+	if 1 != pool.LiveMappings() {
+		t.Errorf("pool.close live:%v", pool.LiveMappings())
+		return
+	}
+	inuse.close(false)
+	if 0 != pool.LiveMappings() {
+		t.Errorf("pool.close live after close:%v", pool.LiveMappings())
+		return
+	}
+
+	// 使用中的文件在下次初始化时reload，Release的文件被清空
+	var reloads []*MMapCache
+	opts.ReloadFunc = func(mmapCaches []*MMapCache) {
+		reloads = mmapCaches
+	}
+	pool, err = NewPool(opts)
+	if nil != err {
+		t.Errorf("pool.close renew err:%v", err)
+		return
+	}
+	defer pool.Close(context.Background())
+	if len(reloads) != 1 || reloads[0].Path() != inuse.Path() || !reloads[0].Has([]byte("key")) {
+		t.Errorf("pool.close reload len:%v", len(reloads))
+		return
+	}
+	t.Logf("pool.close ok")
+}
+
+func TestPoolAllocContext(t *testing.T) {
+	dir := poolTestDir("allocctx")
+	pool, err := NewPool(Options{Dir: dir, MMapSize: 1024 * 16, DataSize: 1024, Prealloc: 4})
+	if nil != err {
+		t.Errorf("pool.allocctx newpool err:%v", err)
+		return
+	}
+	defer pool.Close(context.Background())
+
+	if _, err := pool.AllocContext(context.Background()); nil != err {
+		t.Errorf("pool.allocctx err:%v", err)
+		return
+	}
+	tryOk := false
+	for i := 0; i < 100 && !tryOk; i++ {
+		_, tryOk = pool.TryAlloc()
+		<-time.After(time.Millisecond)
+	}
+	if !tryOk {
+		t.Errorf("pool.allocctx tryalloc failed")
+		return
+	}
+	if count, avg, max := pool.AllocLatency(); count != 2 || avg > max {
+		t.Errorf("pool.allocctx latency count:%v avg:%v max:%v", count, avg, max)
+		return
+	}
+
+	// 没有可分配的文件时，ctx超时返回
+	blocked := &PoolMMapCache{done: make(chan struct{})}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*10)
+	defer cancel()
+	if _, err := blocked.AllocContext(ctx); context.DeadlineExceeded != err {
+		t.Errorf("pool.allocctx timeout err:%v", err)
+		return
+	}
+	if _, ok := blocked.TryAlloc(); ok {
+		t.Errorf("pool.allocctx blocked tryalloc ok")
+		return
+	}
+	t.Logf("pool.allocctx ok")
+}
+
+func TestPoolPreallocMode(t *testing.T) {
+	for _, mode := range []PreallocMode{PreallocWrite, PreallocSparse, PreallocReserve} {
+		dir := poolTestDir("prealloc-" + mode.String())
+		mmapSize := 1024 * 16
+		pool, err := NewPool(Options{Dir: dir, MMapSize: mmapSize, DataSize: 1024, Prealloc: 2, PreallocMode: mode})
+		if nil != err {
+			t.Errorf("pool.prealloc mode:%v newpool err:%v", mode, err)
+			return
+		}
+		if (PreallocWrite == mode) != (nil != pool.template) {
+			t.Errorf("pool.prealloc mode:%v template:%v", mode, len(pool.template))
+			return
+		}
+
+		mmapCache, err := pool.Alloc()
+		if nil != err {
+			t.Errorf("pool.prealloc mode:%v alloc err:%v", mode, err)
+			return
+		}
+		fi, err := os.Stat(mmapCache.Path())
+		if nil != err || int(fi.Size()) != mmapSize {
+			t.Errorf("pool.prealloc mode:%v size err:%v", mode, err)
+			return
+		}
+		if n, err := mmapCache.WriteData(0x1, []byte("data"), []byte("key"), nil); nil != err || n < 0 {
+			t.Errorf("pool.prealloc mode:%v write n:%v err:%v", mode, n, err)
+			return
+		}
+		mmapCache.Release()
+		pool.Close(context.Background())
+	}
+	t.Logf("pool.prealloc ok")
+}
+
+func TestPoolConcurrentRuntime(t *testing.T) {
+	dir := poolTestDir("concurrent")
+	pool, err := NewPool(Options{Dir: dir, MMapSize: 1024 * 16, DataSize: 1024, Prealloc: 4, Concurrent: true})
+	if nil != err {
+		t.Errorf("pool.concurrent newpool err:%v", err)
+		return
+	}
+
+	// 后台goroutine更新指标的同时读取，go test -race 下不应有数据竞争
+	stop := make(chan struct{})
+	dumped := make(chan struct{})
+	go func() {
+		defer close(dumped)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				pool.DumpRuntime()
+				pool.Degraded()
+				pool.SetSyncPolicy(SyncPolicy{Mode: SyncNone})
+			}
+		}
+	}()
+	for i := 0; i < 20; i++ {
+		mmapCache, err := pool.Alloc()
+		if nil != err {
+			t.Errorf("pool.concurrent alloc err:%v", err)
+			break
+		}
+		if !mmapCache.concurrent {
+			t.Errorf("pool.concurrent cache not concurrent")
+			break
+		}
+		mmapCache.Release()
+	}
+	close(stop)
+	<-dumped
+	pool.Close(context.Background())
+
+	if alloc, _, _, size := pool.DumpRuntime(); alloc < 4 || 0 != size {
+		t.Errorf("pool.concurrent alloc:%v size:%v", alloc, size)
+		return
+	}
+	t.Logf("pool.concurrent ok")
+}
+
+type testSink struct {
+	mu      sync.Mutex
+	err     error
+	failKey string
+	datas   []string
+}
+
+func (s *testSink) WriteBatch(ctx context.Context, datas []*MMapData) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if nil != s.err {
+		return s.err
+	}
+	for _, mmapData := range datas {
+		if string(mmapData.GetKey()) == s.failKey {
+			return errors.New("bad record")
+		}
+		s.datas = append(s.datas, string(mmapData.GetData()))
+	}
+	return nil
+}
+
+// blockSink 阻塞到ctx结束
+type blockSink struct {
+	calls int32
+}
+
+func (s *blockSink) WriteBatch(ctx context.Context, datas []*MMapData) error {
+	atomic.AddInt32(&s.calls, 1)
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestFlusher(t *testing.T) {
+	dir := poolTestDir("flusher")
+	opts := Options{Dir: dir, MMapSize: 1024 * 16, DataSize: 1024, Prealloc: 2}
+
+	// 写入数据后不Release，模拟进程崩溃
+	pool, err := NewPool(opts)
+	if nil != err {
+		t.Errorf("flusher newpool err:%v", err)
+		return
+	}
+	mmapCache, _ := pool.Alloc()
+	for i := 0; i < 3; i++ {
+		key := fmt.Sprintf("reload-%v", i)
+		mmapCache.WriteData(0x1, []byte(key), []byte(key), nil)
+	}
+	mmapCache.close(false)
+	pool.Close(context.Background())
+
+	// Sink失败时文件保留
+	failSink := &testSink{err: errors.New("db down")}
+	flusher := NewFlusher(failSink, FlusherOptions{MaxAttempts: 2, RetryMinDelay: time.Millisecond})
+	opts.ReloadFunc = flusher.Reload
+	pool, err = NewPool(opts)
+	if nil != err {
+		t.Errorf("flusher newpool err:%v", err)
+		return
+	}
+	flusher.Close(context.Background())
+	pool.Close(context.Background())
+	if flushed, _, failed, dead := flusher.DumpRuntime(); 0 != flushed || 2 != failed || 1 != dead {
+		t.Errorf("flusher fail flushed:%v failed:%v dead:%v", flushed, failed, dead)
+		return
+	}
+	if err := flusher.Submit(mmapCache); ErrFlusherClosed != err {
+		t.Errorf("flusher submit after close err:%v", err)
+		return
+	}
+
+	// 重启后再次提交，Sink确认后回收
+	sink := &testSink{}
+	flusher = NewFlusher(sink, FlusherOptions{Workers: 2})
+	opts.ReloadFunc = flusher.Reload
+	pool, err = NewPool(opts)
+	if nil != err {
+		t.Errorf("flusher newpool err:%v", err)
+		return
+	}
+	defer pool.Close(context.Background())
+	mmapCache, _ = pool.Alloc()
+	for i := 0; i < 2; i++ {
+		key := fmt.Sprintf("full-%v", i)
+		mmapCache.WriteData(0x1, []byte(key), []byte(key), nil)
+	}
+	flusher.Submit(mmapCache)
+	if err := flusher.Close(context.Background()); nil != err {
+		t.Errorf("flusher close err:%v", err)
+		return
+	}
+	if flushed, records, _, _ := flusher.DumpRuntime(); 2 != flushed || 5 != records || 5 != len(sink.datas) {
+		t.Errorf("flusher flushed:%v records:%v datas:%v", flushed, records, sink.datas)
+		return
+	}
+	t.Logf("flusher ok")
+}
+
+func TestWriter(t *testing.T) {
+	dir := poolTestDir("writer")
+	pool, err := NewPool(Options{Dir: dir, MMapSize: 1024 * 16, DataSize: 1024, Prealloc: 2})
+	if nil != err {
+		t.Errorf("writer newpool err:%v", err)
+		return
+	}
+	defer pool.Close(context.Background())
+
+	if _, err := NewWriter(pool, WriterOptions{}); !errors.Is(err, ErrInvalidOptions) {
+		t.Errorf("writer nil seal err:%v", err)
+		return
+	}
+
+	var sealed []*MMapCache
+	writer, _ := NewWriter(pool, WriterOptions{Seal: func(mmapCache *MMapCache) {
+		sealed = append(sealed, mmapCache)
+	}})
+	putCount := 40
+	for i := 0; i < putCount; i++ {
+		key := fmt.Sprintf("key-%v", i)
+		if err := writer.Put(0x1, []byte(key), []byte(key), nil); nil != err {
+			t.Errorf("writer put err:%v", err)
+			return
+		}
+	}
+	if err := writer.Put(0x1, []byte("big"), make([]byte, 1024), nil); !errors.Is(err, ErrDataSizeOverflow) {
+		t.Errorf("writer put overflow err:%v", err)
+		return
+	}
+	writer.Close()
+	if err := writer.Put(0x1, []byte("key"), []byte("key"), nil); ErrWriterClosed != err {
+		t.Errorf("writer put after close err:%v", err)
+		return
+	}
+
+	total := 0
+	for _, mmapCache := range sealed {
+		total += mmapCache.Len()
+		mmapCache.Release()
+	}
+	if len(sealed) < 3 || total != putCount {
+		t.Errorf("writer sealed:%v total:%v", len(sealed), total)
+		return
+	}
+	t.Logf("writer ok")
+}
+
+func TestWriterSeal(t *testing.T) {
+	dir := poolTestDir("writerseal")
+	pool, err := NewPool(Options{Dir: dir, MMapSize: 1024 * 16, DataSize: 1024, Prealloc: 2})
+	if nil != err {
+		t.Errorf("writer.seal newpool err:%v", err)
+		return
+	}
+	defer pool.Close(context.Background())
+
+	if _, err := NewWriter(pool, WriterOptions{Seal: func(*MMapCache) {}, MaxRecords: -1}); !errors.Is(err, ErrInvalidOptions) {
+		t.Errorf("writer.seal invalid err:%v", err)
+		return
+	}
+
+	// 数据块数量与已使用长度
+	sealed := make(chan *MMapCache, 16)
+	writer, _ := NewWriter(pool, WriterOptions{
+		Seal:       func(mmapCache *MMapCache) { sealed <- mmapCache },
+		MaxRecords: 4,
+		MaxBytes:   1024 * 3,
+	})
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("key-%v", i)
+		writer.Put(0x1, []byte(key), []byte(key), nil)
+	}
+	writer.Close()
+	if len(sealed) != 4 {
+		t.Errorf("writer.seal sealed:%v", len(sealed))
+		return
+	}
+	for len(sealed) > 0 {
+		mmapCache := <-sealed
+		if mmapCache.Len() > 3 || mmapCache.SealTime().IsZero() {
+			t.Errorf("writer.seal len:%v sealtime:%v", mmapCache.Len(), mmapCache.SealTime())
+			return
+		}
+		mmapCache.Release()
+	}
+
+	// 第一次写入后超时封存，封存时间记录在文件头
+	writer, _ = NewWriter(pool, WriterOptions{
+		Seal:   func(mmapCache *MMapCache) { sealed <- mmapCache },
+		MaxAge: time.Millisecond * 20,
+	})
+	defer writer.Close()
+	begin := time.Now()
+	writer.Put(0x1, []byte("key"), []byte("data"), nil)
+	select {
+	case mmapCache := <-sealed:
+		sealTime := ReloadMMapCache(mmapCache.GetWrittenData()).SealTime()
+		if sealTime.Before(begin) || !sealTime.Equal(mmapCache.SealTime()) {
+			t.Errorf("writer.seal age sealtime:%v", sealTime)
+			return
+		}
+		mmapCache.Release()
+	case <-time.After(time.Second):
+		t.Errorf("writer.seal age timeout")
+		return
+	}
+	t.Logf("writer.seal ok")
+}
+
+func TestFlusherDeadLetter(t *testing.T) {
+	dir := poolTestDir("deadletter")
+	deadDir := poolTestDir("deadletter-dead")
+	pool, err := NewPool(Options{Dir: dir, MMapSize: 1024 * 16, DataSize: 1024, Prealloc: 2})
+	if nil != err {
+		t.Errorf("flusher.dead newpool err:%v", err)
+		return
+	}
+	defer pool.Close(context.Background())
+
+	var exhausted int32
+	flusher := NewFlusher(&testSink{err: errors.New("db down")}, FlusherOptions{
+		MaxAttempts:   3,
+		RetryMinDelay: time.Millisecond,
+		RetryMaxDelay: time.Millisecond * 2,
+		DeadLetterDir: deadDir,
+		ErrorFunc: func(err error) {
+			if errors.Is(err, ErrFlushExhausted) {
+				atomic.AddInt32(&exhausted, 1)
+			}
+		},
+	})
+	mmapCache, _ := pool.Alloc()
+	mmapCache.WriteData(0x1, []byte("data"), []byte("key"), nil)
+	cachePath := mmapCache.Path()
+	flusher.Submit(mmapCache)
+	flusher.Close(context.Background())
+
+	if _, _, failed, dead := flusher.DumpRuntime(); 3 != failed || 1 != dead || 1 != atomic.LoadInt32(&exhausted) {
+		t.Errorf("flusher.dead failed:%v dead:%v exhausted:%v", failed, dead, exhausted)
+		return
+	}
+	if _, err := os.Stat(cachePath); !os.IsNotExist(err) {
+		t.Errorf("flusher.dead file still in pool dir err:%v", err)
+		return
+	}
+	deadPath := path.Join(deadDir, path.Base(cachePath)+".err")
+	buf, err := ioutil.ReadFile(deadPath)
+	if nil != err || 1 != ReloadMMapCache(buf).Len() {
+		t.Errorf("flusher.dead read %v err:%v", deadPath, err)
+		return
+	}
+
+	// 没有配置死信目录时，文件关闭后保留在原目录
+	kept := NewFlusher(&testSink{err: errors.New("db down")}, FlusherOptions{MaxAttempts: 1})
+	mmapCache, _ = pool.Alloc()
+	mmapCache.WriteData(0x1, []byte("data"), []byte("key"), nil)
+	cachePath = mmapCache.Path()
+	kept.Submit(mmapCache)
+	kept.Close(context.Background())
+	if nil != mmapCache.mmap {
+		t.Errorf("flusher.dead kept %v not closed", cachePath)
+		return
+	}
+	if buf, err := ioutil.ReadFile(cachePath); nil != err || 1 != ReloadMMapCache(buf).Len() {
+		t.Errorf("flusher.dead kept %v err:%v", cachePath, err)
+		return
+	}
+
+	// Close超时取消WriteBatch时不计入重试耗尽，队列中剩余的文件不再调用Sink，关闭后保留
+	block := &blockSink{}
+	canceled := NewFlusher(block, FlusherOptions{MaxAttempts: 1, DeadLetterDir: deadDir})
+	var queued []*MMapCache
+	for i := 0; i < 2; i++ {
+		mmapCache, _ = pool.Alloc()
+		mmapCache.WriteData(0x1, []byte("data"), []byte("key"), nil)
+		canceled.Submit(mmapCache)
+		queued = append(queued, mmapCache)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*20)
+	defer cancel()
+	if err := canceled.Close(ctx); context.DeadlineExceeded != err {
+		t.Errorf("flusher.dead close err:%v", err)
+		return
+	}
+	canceled.wait.Wait()
+	if _, _, failed, dead := canceled.DumpRuntime(); 1 != failed || 0 != dead || 1 != atomic.LoadInt32(&block.calls) {
+		t.Errorf("flusher.dead canceled failed:%v dead:%v calls:%v", failed, dead, block.calls)
+		return
+	}
+	for _, mmapCache := range queued {
+		if _, err := os.Stat(mmapCache.Path()); nil != err || nil != mmapCache.mmap {
+			t.Errorf("flusher.dead canceled %v err:%v", mmapCache.Path(), err)
+			return
+		}
+	}
+
+	// 队列已满时Reload不会阻塞NewPool
+	canceled = NewFlusher(&blockSink{}, FlusherOptions{QueueSize: 1})
+	queued = queued[:0]
+	for i := 0; i < 4; i++ {
+		mmapCache, _ = pool.Alloc()
+		mmapCache.WriteData(0x1, []byte("data"), []byte("key"), nil)
+		queued = append(queued, mmapCache)
+	}
+	reloaded := make(chan struct{})
+	go func() {
+		canceled.Reload(queued)
+		close(reloaded)
+	}()
+	select {
+	case <-reloaded:
+	case <-time.After(time.Second):
+		t.Errorf("flusher.dead reload blocked")
+		return
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), time.Millisecond*20)
+	defer cancel()
+	canceled.Close(ctx)
+	canceled.reloading.Wait()
+	canceled.wait.Wait()
+	for _, mmapCache := range queued {
+		if nil != mmapCache.mmap {
+			t.Errorf("flusher.dead reload %v not closed", mmapCache.Path())
+			return
+		}
+	}
+
+	for i := 1; i < 5; i++ {
+		if d := flusher.retryDelay(i); d < time.Microsecond*500 || d > time.Millisecond*2 {
+			t.Errorf("flusher.dead retry delay attempt:%v delay:%v", i, d)
+			return
+		}
+	}
+	t.Logf("flusher.dead ok")
+}
+
+func TestReplay(t *testing.T) {
+	cachefile := path.Join(poolpwd, "replay.cachedat.err")
+	createMMapFile(cachefile, make([]byte, 1024*16))
+	defer os.Remove(cachefile)
+	mmapCache, _ := newMMapCache(cachefile, LayoutFixed, 1024, false)
+	for i := 0; i < 5; i++ {
+		key := fmt.Sprintf("key-%v", i)
+		mmapCache.WriteData(0x1, []byte(key), []byte(key), nil)
+	}
+	mmapCache.close(false)
+
+	sink := &testSink{failKey: "key-2"}
+	report, err := Replay(context.Background(), cachefile, sink)
+	if nil != err || 4 != report.Succeeded || 1 != report.Failed || 5 != len(report.Results) || 4 != len(sink.datas) {
+		t.Errorf("replay err:%v report:%+v", err, report)
+		return
+	}
+	if string(report.Results[2].Key) != "key-2" || nil == report.Results[2].Err {
+		t.Errorf("replay result:%+v", report.Results[2])
+		return
+	}
+
+	// 文件只读，Replay之后内容不变
+	if report, _ := Replay(context.Background(), cachefile, &testSink{}); 5 != report.Succeeded {
+		t.Errorf("replay again report:%+v", report)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := Replay(ctx, cachefile, &testSink{}); context.Canceled != err {
+		t.Errorf("replay canceled err:%v", err)
+		return
+	}
+
+	// 文件头损坏时BestEffort仍然可以导出数据
+	buf, _ := ioutil.ReadFile(cachefile)
+	buf[mmapCacheHeadMagicPos] ^= 0xff
+	ioutil.WriteFile(cachefile, buf, 0666)
+	if _, err := Replay(context.Background(), cachefile, &testSink{}); !errors.Is(err, ErrBadHead) {
+		t.Errorf("replay bad magic err:%v", err)
+		return
+	}
+	opts := ReplayOptions{BestEffort: true}
+	if report, err := ReplayWith(context.Background(), cachefile, &testSink{}, opts); nil != err ||
+		5 != report.Succeeded || mmapCacheVersion != report.Version {
+		t.Errorf("replay best effort bad magic err:%v report:%+v", err, report)
+		return
+	}
+	newReplayCache(cachefile, buf).setVersion(0x9)
+	ioutil.WriteFile(cachefile, buf, 0666)
+	if _, err := Replay(context.Background(), cachefile, &testSink{}); ErrUnknownVersion != err {
+		t.Errorf("replay unknown version err:%v", err)
+		return
+	}
+	if report, err := ReplayWith(context.Background(), cachefile, &testSink{}, opts); nil != err ||
+		5 != report.Succeeded || nil != report.ContentErr || mmapCacheVersion != report.Version {
+		t.Errorf("replay best effort unknown version err:%v report:%+v", err, report)
+		return
+	}
+
+	ioutil.WriteFile(cachefile, make([]byte, 100), 0666)
+	if _, err := Replay(context.Background(), cachefile, sink); !errors.Is(err, ErrBadHead) {
+		t.Errorf("replay bad head err:%v", err)
+		return
+	}
+	t.Logf("replay ok")
+}
@@ -1,22 +1,38 @@
 package cache
 
 import (
+	"hash/crc32"
+
 	"mmapcache/byteio"
 )
 
 const (
-	mmapDataHeadLen       = 12
+	mmapDataHeadLenV1     = 12 // version 1 的文件中，数据块没有checksum
+	mmapDataHeadLenV2     = 16 // version 2 的文件中，数据块没有seq
+	mmapDataHeadLen       = 20
 	mmapDataHeadUsedPos   = 4
 	mmapDataHeadTagPos    = mmapDataHeadUsedPos + 4
 	mmapDataHeadKeyLenPos = mmapDataHeadTagPos + 2
-	mmapDataPos           = mmapDataHeadLen
+	mmapDataHeadCrcPos    = mmapDataHeadKeyLenPos + 2
+	mmapDataHeadSeqPos    = mmapDataHeadCrcPos + 4
+
+	mmapDataKeyMaxLen = 0xffff // keylen只有2byte
+
+	mmapDataSizeMask    uint32 = 0x7fffffff // data.size的低31位为数据块大小
+	mmapDataDeletedFlag uint32 = 0x80000000 // data.size的最高位为删除标记（墓碑）
 )
 
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
 // MMapData mmap数据块
-// | ------------------------------------------- head ----------------------------------------| ---------- data ---------- |
-// | -- 4byte:data.size -- | -- 4byte:data.used -- | -- 2byte:datatag -- | -- 2byte:keylen -- | -- keydata -- | -- data -- |
+// | ------------------------------------------- head ------------------------------------------------------------------------| ---------- data ---------- |
+// | -- 4byte:data.size -- | -- 4byte:data.used -- | -- 2byte:datatag -- | -- 2byte:keylen -- | -- 4byte:crc -- | -- 4byte:seq -- | -- keydata -- | -- data -- |
+// data.size的最高位为删除标记，被删除的数据块在reload时会被跳过
+// crc为 keydata+data 的CRC32C，reload时校验不通过的数据块视为损坏
+// seq为同一个key的版本号，每次更新+1，reload时同一个key有多个数据块时保留seq最大的一份
 type MMapData struct {
 	buf     []byte
+	headLen int
 	data    []byte
 	keyLen  int
 	dataLen int
@@ -25,7 +41,12 @@ type MMapData struct {
 
 // GetSize 返回Size
 func (m *MMapData) GetSize() uint32 {
-	return byteio.BytesToUint32(m.buf)
+	return byteio.BytesToUint32(m.buf) & mmapDataSizeMask
+}
+
+// IsDeleted 返回数据块是否已被删除
+func (m *MMapData) IsDeleted() bool {
+	return byteio.BytesToUint32(m.buf)&mmapDataDeletedFlag != 0
 }
 
 // GetTag 返回Tag
@@ -35,7 +56,7 @@ func (m *MMapData) GetTag() uint16 {
 
 // GetKey 返回Key
 func (m *MMapData) GetKey() []byte {
-	return m.buf[mmapDataPos : mmapDataPos+m.keyLen]
+	return m.buf[m.headLen : m.headLen+m.keyLen]
 }
 
 // GetData 返回Data
@@ -54,42 +75,108 @@ func (m *MMapData) ReloadVal(val interface{}) {
 	m.val = val
 }
 
-func reloadMMapData(buf []byte) *MMapData {
+// reloadMMapData 从buf中解析数据块
+// data.size或keylen超出buf范围时返回nil，此时无法定位下一个数据块
+// data.used超出范围时数据块仍可跳过，由verify判定为损坏
+func reloadMMapData(headLen int, buf []byte) *MMapData {
+	if len(buf) < headLen {
+		return nil
+	}
+	size := int(byteio.BytesToUint32(buf) & mmapDataSizeMask)
+	keyLen := int(byteio.BytesToUint16(buf[mmapDataHeadKeyLenPos:]))
+	if size < headLen || size > len(buf) || headLen+keyLen > size {
+		return nil
+	}
+
 	mmapData := &MMapData{
-		buf: buf,
+		buf:     buf[:size],
+		headLen: headLen,
+		keyLen:  keyLen,
+	}
+	mmapData.data = mmapData.buf[headLen+keyLen:]
+	if used := int(mmapData.getUsed()); used >= keyLen && headLen+used <= size {
+		mmapData.dataLen = used - keyLen
 	}
-	mmapData.keyLen = int(byteio.BytesToUint16(buf[mmapDataHeadKeyLenPos:]))
-	mmapData.dataLen = int(byteio.BytesToUint32(buf[mmapDataHeadUsedPos:])) - mmapData.keyLen
-	mmapData.data = mmapData.buf[mmapDataHeadLen+mmapData.keyLen:]
 	return mmapData
 }
 
-func newMMapData(size uint32, tag uint16, buf, key, data []byte, val interface{}) *MMapData {
+// newMMapData 在buf上写入数据块，但不写入data.size
+// 写完后需要调用commit，数据块才会在reload时生效
+func newMMapData(headLen int, size uint32, tag uint16, seq uint32, buf, key, data []byte, val interface{}) *MMapData {
 	used := len(key) + len(data)
-	if (used + mmapDataHeadLen) > int(size) {
+	if (used + headLen) > int(size) {
 		return nil
 	}
 
+	// 限定在数据块范围内，更新数据时不会越界写到下一个数据块
+	buf = buf[:size]
 	mmapData := &MMapData{
 		buf:     buf,
-		data:    buf[mmapDataHeadLen+len(key):],
+		headLen: headLen,
+		data:    buf[headLen+len(key):],
 		keyLen:  len(key),
 		dataLen: len(data),
 		val:     val,
 	}
-	byteio.Uint32ToBytes(size, mmapData.buf)
 	byteio.Uint16ToBytes(tag, mmapData.buf[mmapDataHeadTagPos:])
 	byteio.Uint16ToBytes(uint16(len(key)), mmapData.buf[mmapDataHeadKeyLenPos:])
-	copy(mmapData.buf[mmapDataPos:], key)
+	if mmapData.hasSeq() {
+		byteio.Uint32ToBytes(seq, mmapData.buf[mmapDataHeadSeqPos:])
+	}
+	copy(mmapData.buf[headLen:], key)
 
 	mmapData.writeData(data)
 	return mmapData
 }
 
+// commit 写入data.size，通过cache一次copy写入
+// 复用已删除的数据块时，在此之前墓碑标记一直有效，reload不会看到写了一半的数据块
+func (m *MMapData) commit(cache []byte) {
+	byteio.SafeUint32ToBytes(uint32(len(m.buf)), m.buf, cache)
+}
+
 func (m *MMapData) writeData(data []byte) {
 	m.dataLen = len(data)
 	byteio.Uint32ToBytes(uint32(m.keyLen+m.dataLen), m.buf[mmapDataHeadUsedPos:])
 	copy(m.data, data)
+	if m.hasCrc() {
+		byteio.Uint32ToBytes(m.calcCrc(), m.buf[mmapDataHeadCrcPos:])
+	}
+}
+
+// verify 校验数据块的长度与checksum，version 1 的数据块只校验长度
+func (m *MMapData) verify() bool {
+	if int(m.getUsed()) != m.keyLen+m.dataLen {
+		return false
+	}
+	if !m.hasCrc() {
+		return true
+	}
+	return byteio.BytesToUint32(m.buf[mmapDataHeadCrcPos:]) == m.calcCrc()
+}
+
+func (m *MMapData) hasSeq() bool {
+	return m.headLen >= mmapDataHeadSeqPos+4
+}
+
+func (m *MMapData) getSeq() uint32 {
+	if !m.hasSeq() {
+		return 0
+	}
+	return byteio.BytesToUint32(m.buf[mmapDataHeadSeqPos:])
+}
+
+func (m *MMapData) hasCrc() bool {
+	return m.headLen >= mmapDataHeadCrcPos+4
+}
+
+func (m *MMapData) calcCrc() uint32 {
+	return crc32.Checksum(m.buf[m.headLen:m.headLen+m.keyLen+m.dataLen], crc32cTable)
+}
+
+// markDeleted 将data.size的最高位置为删除标记，通过cache一次copy写入，保证标记的原子性
+func (m *MMapData) markDeleted(cache []byte) {
+	byteio.SafeUint32ToBytes(m.GetSize()|mmapDataDeletedFlag, m.buf, cache)
 }
 
 func (m *MMapData) getUsed() uint32 {
@@ -105,5 +192,5 @@ func (m *MMapData) getDataUsed() uint32 {
 }
 
 func (m *MMapData) getHead() []byte {
-	return m.buf[:mmapDataPos]
+	return m.buf[:m.headLen]
 }
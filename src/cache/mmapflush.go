@@ -0,0 +1,305 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"path"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// ErrFlusherClosed Flusher已关闭，不再接收新的MMapCache
+	ErrFlusherClosed = errors.New("mmap cache flusher closed")
+	// ErrFlushExhausted Sink重试次数耗尽，MMapCache被移动到死信目录（或保留在原目录）
+	ErrFlushExhausted = errors.New("mmap cache flush retries exhausted")
+)
+
+const (
+	flushMaxAttempts   = 3
+	flushRetryMinDelay = time.Millisecond * 100
+	flushRetryMaxDelay = time.Second * 10
+	deadLetterSuffix   = ".err"
+)
+
+// Sink 数据的最终落地（例如批量写db）
+// WriteBatch 返回nil表示这批数据已经持久化，之后MMapCache会被Release回收
+// 同一批数据可能因为失败或进程崩溃被再次提交，Sink需要保证写入是幂等的
+type Sink interface {
+	WriteBatch(ctx context.Context, datas []*MMapData) error
+}
+
+// FlusherOptions Flusher的配置
+type FlusherOptions struct {
+	Workers   int         // 并发调用Sink的goroutine数量，默认1
+	QueueSize int         // 等待flush的MMapCache队列长度，队列满时Submit阻塞，默认Workers*2
+	ErrorFunc func(error) // Sink返回错误时通过此函数异步抛出
+	Logger    Logger      // 为nil时不输出日志
+
+	// Sink失败时按指数退避（带随机抖动）重试，重试期间占用一个worker
+	MaxAttempts   int           // 每个MMapCache调用Sink的最大次数，默认3
+	RetryMinDelay time.Duration // 第一次重试前的等待时长，默认100ms，之后每次翻倍
+	RetryMaxDelay time.Duration // 重试等待时长的上限，默认10s
+	// DeadLetterDir 重试耗尽后，文件被关闭并移动到此目录（文件名加.err后缀），不会再被缓存池reload
+	// 为空时文件保留在缓存池目录中，下次初始化时reload再次提交
+	DeadLetterDir string
+}
+
+// Flusher 将写满（或到期）的MMapCache交给Sink落地，Sink确认后才Release回收文件
+// Sink失败或进程崩溃时文件保留在缓存池目录中，下次初始化时通过ReloadFunc再次提交，保证at-least-once
+//
+//	flusher := NewFlusher(sink, FlusherOptions{})
+//	opts.ReloadFunc = flusher.Reload
+//	pool, err := NewPool(opts)
+//	...
+//	flusher.Submit(fullCache)
+type Flusher struct {
+	flushCounter  uint64 // 原子操作的64位字段放在最前面，保证32位平台上的对齐
+	recordCounter uint64
+	failCounter   uint64
+	deadCounter   uint64
+
+	sink          Sink
+	queue         chan *MMapCache
+	maxAttempts   int
+	retryMinDelay time.Duration
+	retryMaxDelay time.Duration
+	deadLetterDir string
+	errorfuc      func(error)
+	logger        Logger
+	ctx           context.Context
+	cancel        context.CancelFunc
+	mu            sync.RWMutex // 保护closing与closed，Close与Submit互斥
+	closing       bool         // Close开始后不再接收新的Reload
+	closed        bool
+	reloading     sync.WaitGroup // 后台提交中的Reload，Close等待它们提交完成后再关闭队列
+	closeOnce     sync.Once
+	wait          sync.WaitGroup
+}
+
+// NewFlusher 创建一个Flusher，并启动后台goroutine
+func NewFlusher(sink Sink, opts FlusherOptions) *Flusher {
+	if opts.Workers <= 0 {
+		opts.Workers = 1
+	}
+	if opts.QueueSize <= 0 {
+		opts.QueueSize = opts.Workers * 2
+	}
+	if nil == opts.ErrorFunc {
+		opts.ErrorFunc = func(error) {}
+	}
+	if opts.MaxAttempts <= 0 {
+		opts.MaxAttempts = flushMaxAttempts
+	}
+	if opts.RetryMinDelay <= 0 {
+		opts.RetryMinDelay = flushRetryMinDelay
+	}
+	if opts.RetryMaxDelay <= 0 {
+		opts.RetryMaxDelay = flushRetryMaxDelay
+	}
+	if opts.RetryMaxDelay < opts.RetryMinDelay {
+		opts.RetryMaxDelay = opts.RetryMinDelay
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	flusher := &Flusher{
+		sink:          sink,
+		queue:         make(chan *MMapCache, opts.QueueSize),
+		maxAttempts:   opts.MaxAttempts,
+		retryMinDelay: opts.RetryMinDelay,
+		retryMaxDelay: opts.RetryMaxDelay,
+		deadLetterDir: opts.DeadLetterDir,
+		errorfuc:      opts.ErrorFunc,
+		logger:        opts.Logger,
+		ctx:           ctx,
+		cancel:        cancel,
+	}
+	flusher.wait.Add(opts.Workers)
+	for i := 0; i < opts.Workers; i++ {
+		go flusher.flushLoop()
+	}
+	return flusher
+}
+
+// Submit 提交一个不再写入的MMapCache，Sink确认后自动Release
+// 提交之后业务层不能再使用此MMapCache；队列满时阻塞
+// Flusher已关闭时返回 ErrFlusherClosed
+func (m *Flusher) Submit(mmcache *MMapCache) error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.closed {
+		return ErrFlusherClosed
+	}
+	m.queue <- mmcache
+	return nil
+}
+
+// Reload 提交缓存池初始化时reload得到的MMapCache，可以直接作为Options.ReloadFunc使用
+// 在后台goroutine中逐个提交，队列满时不会阻塞NewPool；Close会等待这些MMapCache提交完成
+// Flusher已关闭时MMapCache被关闭，文件保留，下次初始化时再reload
+func (m *Flusher) Reload(mmcaches []*MMapCache) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.closing {
+		for _, mmcache := range mmcaches {
+			m.reloadFail(mmcache, ErrFlusherClosed)
+		}
+		return
+	}
+	m.reloading.Add(1)
+	go func() {
+		defer m.reloading.Done()
+		for _, mmcache := range mmcaches {
+			if err := m.Submit(mmcache); nil != err {
+				m.reloadFail(mmcache, err)
+			}
+		}
+	}()
+}
+
+func (m *Flusher) reloadFail(mmcache *MMapCache, err error) {
+	m.errorfuc(fmt.Errorf("mmap cache %v reload submit err:%v", mmcache.Path(), err))
+	mmcache.close(false)
+}
+
+// Close 关闭Flusher，不再接收新的MMapCache，等待队列中的MMapCache全部flush完成
+// ctx 超时前没有完成时，取消进行中的WriteBatch并返回 ctx.Err()，未完成的文件保留，下次初始化时reload
+func (m *Flusher) Close(ctx context.Context) error {
+	m.closeOnce.Do(func() {
+		go func() {
+			m.mu.Lock()
+			m.closing = true
+			m.mu.Unlock()
+			m.reloading.Wait()
+
+			m.mu.Lock()
+			defer m.mu.Unlock()
+			m.closed = true
+			close(m.queue)
+		}()
+	})
+
+	exited := make(chan struct{})
+	go func() {
+		m.wait.Wait()
+		close(exited)
+	}()
+	select {
+	case <-exited:
+		m.cancel()
+		return nil
+	case <-ctx.Done():
+		m.cancel()
+		return ctx.Err()
+	}
+}
+
+// DumpRuntime 获取Flusher当前的数据指标
+// FlushCounter（成功flush的文件数）, RecordCounter（成功flush的数据块数）, FailCounter（Sink失败的次数）,
+// DeadCounter（重试耗尽的文件数）
+func (m *Flusher) DumpRuntime() (uint64, uint64, uint64, uint64) {
+	return atomic.LoadUint64(&m.flushCounter), atomic.LoadUint64(&m.recordCounter),
+		atomic.LoadUint64(&m.failCounter), atomic.LoadUint64(&m.deadCounter)
+}
+
+func (m *Flusher) flushLoop() {
+	defer m.wait.Done()
+	for mmcache := range m.queue {
+		m.flush(mmcache)
+	}
+}
+
+// flush 将MMapCache中的数据交给Sink，成功后Release
+// 失败时按退避策略重试，重试耗尽后文件不回收，移动到死信目录或保留在原目录
+// Close超时后不再调用Sink，队列中剩余的文件关闭后保留在原目录，下次初始化时reload
+func (m *Flusher) flush(mmcache *MMapCache) error {
+	datas := mmcache.GetMMapDatas()
+	for attempt := 1; len(datas) > 0; attempt++ {
+		if err := m.ctx.Err(); nil != err {
+			m.keep(mmcache)
+			return err
+		}
+		err := m.sink.WriteBatch(m.ctx, datas)
+		if nil == err {
+			break
+		}
+		atomic.AddUint64(&m.failCounter, 1)
+		m.logf("mmap cache flusher %v records:%v attempt:%v err:%v", mmcache.Path(), len(datas), attempt, err)
+		m.errorfuc(fmt.Errorf("mmap cache %v flush attempt:%v err:%v", mmcache.Path(), attempt, err))
+		// Close超时取消了WriteBatch，不计入重试耗尽，文件保留在原目录
+		if nil != m.ctx.Err() {
+			m.keep(mmcache)
+			return err
+		}
+		if attempt >= m.maxAttempts {
+			m.deadLetter(mmcache)
+			return fmt.Errorf("%w attempts:%v: %v", ErrFlushExhausted, attempt, err)
+		}
+		// Close超时时放弃重试，文件保留在原目录
+		select {
+		case <-time.After(m.retryDelay(attempt)):
+		case <-m.ctx.Done():
+			m.keep(mmcache)
+			return err
+		}
+	}
+	atomic.AddUint64(&m.flushCounter, 1)
+	atomic.AddUint64(&m.recordCounter, uint64(len(datas)))
+	mmcache.Release()
+	return nil
+}
+
+// retryDelay 第attempt次失败后的等待时长：RetryMinDelay*2^(attempt-1)，不超过RetryMaxDelay，
+// 再在 [delay/2, delay] 之间随机，避免多个worker同时重试
+func (m *Flusher) retryDelay(attempt int) time.Duration {
+	delay := m.retryMinDelay
+	for i := 1; i < attempt && delay < m.retryMaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > m.retryMaxDelay {
+		delay = m.retryMaxDelay
+	}
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(delay-half)+1))
+}
+
+// deadLetter 重试耗尽，关闭文件并移动到死信目录
+// 没有配置死信目录或移动失败时，文件关闭后保留在缓存池目录中，下次初始化时reload
+func (m *Flusher) deadLetter(mmcache *MMapCache) {
+	atomic.AddUint64(&m.deadCounter, 1)
+	filePath := mmcache.Path()
+	m.keep(mmcache)
+	if "" == m.deadLetterDir {
+		m.errorfuc(fmt.Errorf("%w %v kept", ErrFlushExhausted, filePath))
+		return
+	}
+
+	deadPath := path.Join(m.deadLetterDir, path.Base(filePath)+deadLetterSuffix)
+	err := os.MkdirAll(m.deadLetterDir, os.ModePerm)
+	if nil == err {
+		err = os.Rename(filePath, deadPath)
+	}
+	if nil != err {
+		m.logf("mmap cache flusher %v dead letter err:%v", filePath, err)
+		m.errorfuc(fmt.Errorf("%w %v dead letter err:%v", ErrFlushExhausted, filePath, err))
+		return
+	}
+	m.logf("mmap cache flusher %v moved to dead letter %v", filePath, deadPath)
+	m.errorfuc(fmt.Errorf("%w %v moved to %v", ErrFlushExhausted, filePath, deadPath))
+}
+
+// keep 不回收文件，刷盘后关闭，释放fd与映射
+func (m *Flusher) keep(mmcache *MMapCache) {
+	mmcache.Flush()
+	mmcache.close(false)
+}
+
+func (m *Flusher) logf(format string, v ...interface{}) {
+	if nil != m.logger {
+		m.logger.Printf(format, v...)
+	}
+}
@@ -0,0 +1,75 @@
+package cache
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+const mmapMigrateSuffix = ".migrate"
+
+var (
+	// ErrMigrateCorrupt 文件中有校验失败的数据块，升级会丢弃这些数据块，因此拒绝升级
+	ErrMigrateCorrupt = errors.New("mmap cache migrate corrupt records")
+	// ErrMigrateReopen 文件已经升级并覆盖了原文件，但重新打开失败，原MMapCache已关闭不能再使用
+	ErrMigrateReopen = errors.New("mmap cache migrate reopen failed")
+)
+
+// migrateMMapCache 将旧version的文件升级到当前version，临时文件使用mode权限
+// 先把有效的数据块写入临时文件，刷盘后再rename覆盖原文件，升级过程中崩溃不会丢失原文件的数据
+// 有校验失败的数据块时返回 ErrMigrateCorrupt，数据块升级后超出datasize时返回 ErrDataSizeOverflow，原文件都不会被修改
+// 升级成功后原MMapCache被关闭，返回重新加载的MMapCache；失败时原MMapCache保持不变，
+// 只有返回 ErrMigrateReopen 时原MMapCache已关闭，升级后的文件保留在原路径，下次初始化时再加载
+func migrateMMapCache(old *MMapCache, mode os.FileMode) (*MMapCache, error) {
+	if len(old.corruptAry) > 0 {
+		return nil, fmt.Errorf("%w count:%v", ErrMigrateCorrupt, len(old.corruptAry))
+	}
+	// 数据块head变长，接近datasize的旧数据块在固定分配方式下可能放不下
+	if LayoutFixed == old.layout {
+		for _, mmapData := range old.mmapdataAry {
+			if used := mmapDataHeadLen + mmapData.keyLen + mmapData.dataLen; used > old.dataSize {
+				return nil, fmt.Errorf("%w migrate key:%v used:%v datasize:%v",
+					ErrDataSizeOverflow, string(mmapData.GetKey()), used, old.dataSize)
+			}
+		}
+	}
+
+	// 临时文件需要实际占用磁盘块，磁盘满时返回错误，而不是写入mmap时触发SIGBUS
+	tmpPath := old.path + mmapMigrateSuffix
+	if err := createMMapFileSize(tmpPath, len(old.buf), nil, mode, PreallocReserve); nil != err {
+		return nil, err
+	}
+
+	mmapCache, err := newMMapCache(tmpPath, old.layout, old.dataSize, false)
+	if nil != err {
+		os.Remove(tmpPath)
+		return nil, err
+	}
+	for _, mmapData := range old.mmapdataAry {
+		n, err := mmapCache.WriteData(mmapData.GetTag(), mmapData.GetData(), mmapData.GetKey(), mmapData.GetVal())
+		if nil == err && -1 == n {
+			err = fmt.Errorf("mmap cache migrate no space for key:%v", string(mmapData.GetKey()))
+		}
+		if nil != err {
+			mmapCache.close(true)
+			return nil, err
+		}
+	}
+	mmapCache.SetStatus(old.GetStatus())
+	if err := mmapCache.Flush(); nil != err {
+		mmapCache.close(true)
+		return nil, err
+	}
+	mmapCache.close(false)
+
+	if err := os.Rename(tmpPath, old.path); nil != err {
+		os.Remove(tmpPath)
+		return nil, err
+	}
+	old.close(false)
+	mmapCache, err = newMMapCache(old.path, old.layout, old.dataSize, true)
+	if nil != err {
+		return nil, fmt.Errorf("%w %v", ErrMigrateReopen, err)
+	}
+	return mmapCache, nil
+}
@@ -0,0 +1,155 @@
+package cache
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// mmapDataAlign LayoutVariable 默认的数据块对齐长度
+const mmapDataAlign = 8
+
+// ErrInvalidOptions 缓存池配置不合法
+var ErrInvalidOptions = errors.New("mmap cache invalid options")
+
+// Logger 缓存池的日志输出，*log.Logger 即满足此接口
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// Options 缓存池的配置
+// 除Dir外，未设置（零值）的配置项会使用DefaultOptions中的默认值
+type Options struct {
+	Dir      string // 缓存文件目录，每个缓存池需要使用独立的目录
+	Layout   Layout // 数据块的分配方式
+	MMapSize int    // 缓存文件大小
+	DataSize int    // 缓存数据块大小，Layout为LayoutVariable时为数据块的对齐长度
+	Prealloc int    // 初始化缓存池时，会预先构建的缓存文件数量，空闲时缓存池也会回收到这个数量
+
+	LowWatermark    int           // 缓存池中的文件少于此数量时，后台补充新的文件，默认为Prealloc/2
+	HighWatermark   int           // 缓存池中的文件达到此数量时，Release的文件直接删除，默认为Prealloc*2
+	RecycleInterval time.Duration // 空闲时回收多余文件的间隔
+	FileMode        os.FileMode   // 缓存文件的权限
+	PreallocMode    PreallocMode  // 缓存文件的预分配方式，默认PreallocWrite
+
+	// ErrorFunc 当出现异常，会出发此函数异步抛出error
+	ErrorFunc func(error)
+	// ReloadFunc 当本地有之前的缓存数据时，通过此函数处理已经缓存到本地的数据
+	// 这批数据会初始化为MMapCache对象，但不会被添加到缓存池中（因为其中已经有数据，处于正在使用状态）
+	// 为nil时这批数据不做处理，文件保留在目录中，下次初始化时会再次加载
+	ReloadFunc func([]*MMapCache)
+
+	SyncPolicy SyncPolicy // Alloc分配出的MMapCache使用的刷盘策略
+	Concurrent bool       // Alloc分配出的MMapCache是否开启并发模式，见MMapCache.SetConcurrent
+	Logger     Logger     // 为nil时不输出日志
+}
+
+// DefaultOptions 返回默认的缓存池配置
+// 1MB的缓存文件，8KB的固定数据块，预分配10个文件
+func DefaultOptions(dir string) Options {
+	return Options{
+		Dir:             dir,
+		Layout:          LayoutFixed,
+		MMapSize:        1024 * 1024,
+		DataSize:        1024 * 8,
+		Prealloc:        10,
+		RecycleInterval: time.Second,
+		FileMode:        0666,
+	}
+}
+
+// withDefaults 用默认值补齐未设置的配置项
+func (o Options) withDefaults() Options {
+	def := DefaultOptions(o.Dir)
+	if 0 == o.MMapSize {
+		o.MMapSize = def.MMapSize
+	}
+	if 0 == o.DataSize && LayoutVariable == o.Layout {
+		o.DataSize = mmapDataAlign
+	} else if 0 == o.DataSize {
+		o.DataSize = def.DataSize
+	}
+	if 0 == o.Prealloc {
+		o.Prealloc = def.Prealloc
+	}
+	if 0 == o.LowWatermark {
+		o.LowWatermark = o.Prealloc / 2
+		if o.LowWatermark < 1 {
+			o.LowWatermark = 1
+		}
+	}
+	if 0 == o.HighWatermark {
+		o.HighWatermark = o.Prealloc * 2
+	}
+	if 0 == o.RecycleInterval {
+		o.RecycleInterval = def.RecycleInterval
+	}
+	if 0 == o.FileMode {
+		o.FileMode = def.FileMode
+	}
+	if nil == o.ErrorFunc {
+		o.ErrorFunc = func(error) {}
+	}
+	if nil == o.ReloadFunc {
+		o.ReloadFunc = func([]*MMapCache) {}
+	}
+	return o
+}
+
+// validate 校验配置项之间的组合是否合法
+func (o Options) validate() error {
+	if "" == o.Dir {
+		return fmt.Errorf("%w dir is empty", ErrInvalidOptions)
+	}
+	if o.MMapSize <= mmapCacheHeadSize {
+		return fmt.Errorf("%w mmapsize:%v <= headsize:%v", ErrInvalidOptions, o.MMapSize, mmapCacheHeadSize)
+	}
+	switch o.Layout {
+	case LayoutFixed:
+		if o.DataSize <= mmapDataHeadLen {
+			return fmt.Errorf("%w datasize:%v <= data.headsize:%v", ErrInvalidOptions, o.DataSize, mmapDataHeadLen)
+		}
+	case LayoutVariable:
+		if o.DataSize <= 0 {
+			return fmt.Errorf("%w datasize:%v", ErrInvalidOptions, o.DataSize)
+		}
+	default:
+		return fmt.Errorf("%w layout:%v", ErrInvalidOptions, o.Layout)
+	}
+	if o.DataSize > o.MMapSize-mmapCacheHeadSize {
+		return fmt.Errorf("%w datasize:%v > mmapsize:%v - headsize:%v",
+			ErrInvalidOptions, o.DataSize, o.MMapSize, mmapCacheHeadSize)
+	}
+	if o.Prealloc <= 0 {
+		return fmt.Errorf("%w prealloc:%v", ErrInvalidOptions, o.Prealloc)
+	}
+	if o.LowWatermark < 1 || o.LowWatermark > o.Prealloc {
+		return fmt.Errorf("%w lowwatermark:%v prealloc:%v", ErrInvalidOptions, o.LowWatermark, o.Prealloc)
+	}
+	if o.HighWatermark < o.Prealloc {
+		return fmt.Errorf("%w highwatermark:%v prealloc:%v", ErrInvalidOptions, o.HighWatermark, o.Prealloc)
+	}
+	switch o.PreallocMode {
+	case PreallocWrite, PreallocSparse, PreallocReserve:
+	default:
+		return fmt.Errorf("%w prealloc.mode:%v", ErrInvalidOptions, o.PreallocMode)
+	}
+	if o.RecycleInterval < 0 {
+		return fmt.Errorf("%w recycleinterval:%v", ErrInvalidOptions, o.RecycleInterval)
+	}
+	switch o.SyncPolicy.Mode {
+	case SyncNone, SyncEveryWrite:
+	case SyncEveryN:
+		if o.SyncPolicy.Writes <= 0 {
+			return fmt.Errorf("%w sync.writes:%v", ErrInvalidOptions, o.SyncPolicy.Writes)
+		}
+	case SyncInterval:
+		if o.SyncPolicy.Interval <= 0 {
+			return fmt.Errorf("%w sync.interval:%v", ErrInvalidOptions, o.SyncPolicy.Interval)
+		}
+	default:
+		return fmt.Errorf("%w sync.mode:%v", ErrInvalidOptions, o.SyncPolicy.Mode)
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+package cache
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+)
+
+// errNoFallocate 当前系统或文件系统不支持fallocate
+var errNoFallocate = errors.New("mmap cache fallocate not supported")
+
+// preallocZeroChunk PreallocReserve退化为写入全0内容时，每次写入的长度
+const preallocZeroChunk = 64 * 1024
+
+// PreallocMode 缓存文件的预分配方式
+type PreallocMode int
+
+const (
+	// PreallocWrite 写入mmapsize长度的全0内容，每个文件都需要完整写一次磁盘，缓存池会持有一份mmapsize大小的模板
+	PreallocWrite PreallocMode = iota
+	// PreallocSparse 通过Truncate创建稀疏文件，不占用磁盘块，首次写入时才分配，磁盘满时写入会触发SIGBUS
+	PreallocSparse
+	// PreallocReserve 通过fallocate预留磁盘块，不需要写入内容；非Linux系统或文件系统不支持时退化为写入全0内容（不使用模板）
+	PreallocReserve
+)
+
+func (p PreallocMode) String() string {
+	switch p {
+	case PreallocWrite:
+		return "write"
+	case PreallocSparse:
+		return "sparse"
+	case PreallocReserve:
+		return "reserve"
+	}
+	return "unknown"
+}
+
+func createMMapTemplate(size int) []byte {
+	template := make([]byte, size)
+	for index := 0; index < size; index++ {
+		template[index] = mmapInitByte
+	}
+	return template
+}
+
+func createMMapFile(file string, template []byte) error {
+	return createMMapFileMode(file, template, 0666)
+}
+
+func createMMapFileMode(file string, template []byte, mode os.FileMode) error {
+	return ioutil.WriteFile(file, template, mode)
+}
+
+// createMMapFileSize 按预分配方式创建size大小的缓存文件
+// PreallocWrite 需要传入size大小的template，其余方式template可以为nil
+func createMMapFileSize(file string, size int, template []byte, mode os.FileMode, prealloc PreallocMode) error {
+	if PreallocWrite == prealloc {
+		return createMMapFileMode(file, template, mode)
+	}
+
+	f, err := os.OpenFile(file, os.O_RDWR|os.O_CREATE|os.O_TRUNC, mode)
+	if nil != err {
+		return err
+	}
+	if PreallocReserve == prealloc {
+		if err = fallocate(f, int64(size)); errNoFallocate == err {
+			err = writeZero(f, size)
+		}
+	} else {
+		err = f.Truncate(int64(size))
+	}
+	if cerr := f.Close(); nil == err {
+		err = cerr
+	}
+	return err
+}
+
+// writeZero 分块写入size长度的全0内容，磁盘空间不足时返回错误
+func writeZero(f *os.File, size int) error {
+	chunk := make([]byte, preallocZeroChunk)
+	for size > 0 {
+		n := len(chunk)
+		if n > size {
+			n = size
+		}
+		if _, err := f.Write(chunk[:n]); nil != err {
+			return err
+		}
+		size -= n
+	}
+	return nil
+}
@@ -0,0 +1,18 @@
+//go:build linux
+// +build linux
+
+package cache
+
+import (
+	"os"
+	"syscall"
+)
+
+// fallocate 为文件预留size大小的磁盘块，文件系统不支持时返回 errNoFallocate
+func fallocate(f *os.File, size int64) error {
+	err := syscall.Fallocate(int(f.Fd()), 0, 0, size)
+	if syscall.EOPNOTSUPP == err || syscall.ENOSYS == err {
+		return errNoFallocate
+	}
+	return err
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package cache
+
+import "os"
+
+// fallocate 非Linux系统不支持预留磁盘块
+func fallocate(f *os.File, size int64) error {
+	return errNoFallocate
+}
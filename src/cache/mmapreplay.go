@@ -0,0 +1,121 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+)
+
+// replayVersions BestEffort时文件头的version无法识别，依次尝试的版本，从新到旧
+var replayVersions = []uint16{mmapCacheVersion, mmapCacheVersionV3, mmapCacheVersionV2, mmapCacheVersionV1}
+
+// ReplayOptions Replay的配置
+type ReplayOptions struct {
+	// BestEffort 文件头损坏时尽量导出数据：忽略magic、checksum与version的校验，
+	// version可以识别时按对应的数据块head长度扫描，无法识别时依次尝试各个版本，取解析出数据块最多的一个
+	BestEffort bool
+}
+
+// ReplayResult 单个数据块的Replay结果
+type ReplayResult struct {
+	Tag uint16
+	Key []byte
+	Err error // Sink返回的错误，nil表示成功
+}
+
+// ReplayReport 一个缓存文件的Replay结果
+type ReplayReport struct {
+	Path      string
+	Version   uint16         // 解析数据块使用的版本，BestEffort时可能是猜测的结果
+	Results   []ReplayResult // 每个有效数据块的结果，按文件中的顺序
+	Succeeded int
+	Failed    int
+	Corrupt   int // checksum校验失败被跳过的数据块数量
+	// ContentErr 文件内容损坏时只Replay损坏位置之前的数据块，这里记录损坏的位置（ErrCorruptContent）
+	ContentErr error
+}
+
+// Replay 只读的打开一个缓存文件（.cachedat，或被隔离的.err），将其中的数据块逐个交给Sink
+// 每个数据块单独调用一次WriteBatch，结果记录在ReplayReport.Results中，Sink失败不会中断Replay
+// 文件头损坏或无法识别时返回 ErrBadHead / ErrUnknownVersion；ctx结束时返回已完成部分的报告与 ctx.Err()
+// 文件本身不会被修改，Replay成功后由调用方决定是否删除
+func Replay(ctx context.Context, filePath string, sink Sink) (*ReplayReport, error) {
+	return ReplayWith(ctx, filePath, sink, ReplayOptions{})
+}
+
+// ReplayWith 同 Replay，opts.BestEffort 时文件头校验失败也会尝试导出数据
+func ReplayWith(ctx context.Context, filePath string, sink Sink, opts ReplayOptions) (*ReplayReport, error) {
+	buf, err := ioutil.ReadFile(filePath)
+	if nil != err {
+		return nil, err
+	}
+	if len(buf) < mmapCacheHeadSize {
+		return nil, fmt.Errorf("%w size:%v", ErrBadHead, len(buf))
+	}
+
+	report := &ReplayReport{Path: filePath}
+	mmcache := newReplayCache(filePath, buf)
+	if 0 == mmcache.getWritePos() {
+		return report, nil
+	}
+	if opts.BestEffort {
+		mmcache, report.ContentErr = guessReplayCache(filePath, buf)
+	} else {
+		if err := mmcache.checkHead(); nil != err {
+			return nil, err
+		}
+		report.ContentErr = mmcache.init(true)
+	}
+	report.Version = mmcache.getVersion()
+	report.Corrupt = len(mmcache.corruptAry)
+
+	for _, mmapData := range mmcache.mmapdataAry {
+		if err := ctx.Err(); nil != err {
+			return report, err
+		}
+		err := sink.WriteBatch(ctx, []*MMapData{mmapData})
+		report.Results = append(report.Results, ReplayResult{
+			Tag: mmapData.GetTag(),
+			Key: mmapData.GetKey(),
+			Err: err,
+		})
+		if nil == err {
+			report.Succeeded++
+		} else {
+			report.Failed++
+		}
+	}
+	return report, nil
+}
+
+func newReplayCache(filePath string, buf []byte) *MMapCache {
+	return &MMapCache{
+		path:             filePath,
+		buf:              buf,
+		writeContent:     buf[mmapCacheContentPos:],
+		writeUint32Cache: make([]byte, 4),
+	}
+}
+
+// guessReplayCache 不校验文件头，按version对应的数据块head长度加载数据块
+// version无法识别时在buf的副本上依次尝试 replayVersions，数据块数量相同时优先没有ContentErr的、较新的版本
+func guessReplayCache(filePath string, buf []byte) (*MMapCache, error) {
+	mmcache := newReplayCache(filePath, buf)
+	version := mmcache.getVersion()
+	if 0 != version && version <= mmapCacheVersion {
+		return mmcache, mmcache.init(true)
+	}
+
+	var best *MMapCache
+	var bestErr error
+	for _, version := range replayVersions {
+		guess := newReplayCache(filePath, append([]byte(nil), buf...))
+		guess.setVersion(version)
+		err := guess.init(true)
+		if nil == best || len(guess.mmapdataAry) > len(best.mmapdataAry) ||
+			(len(guess.mmapdataAry) == len(best.mmapdataAry) && nil != bestErr && nil == err) {
+			best, bestErr = guess, err
+		}
+	}
+	return best, bestErr
+}
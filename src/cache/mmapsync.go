@@ -0,0 +1,106 @@
+package cache
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// ErrFlushRange FlushRange的off超出了文件范围
+var ErrFlushRange = errors.New("mmap cache flush range out of bounds")
+
+// SyncMode mmap内存刷盘（msync）的时机
+type SyncMode int
+
+const (
+	// SyncNone 不主动刷盘，依赖内核的回写，进程崩溃不丢数据，机器崩溃可能丢数据
+	SyncNone SyncMode = iota
+	// SyncEveryWrite 每次写入后立即刷盘
+	SyncEveryWrite
+	// SyncEveryN 每写入N次刷盘一次
+	SyncEveryN
+	// SyncInterval 写入后最多间隔Interval刷盘一次
+	SyncInterval
+)
+
+// SyncPolicy 刷盘策略
+type SyncPolicy struct {
+	Mode     SyncMode
+	Writes   int           // SyncEveryN 时的写入次数
+	Interval time.Duration // SyncInterval 时的刷盘间隔
+}
+
+// SetSyncPolicy 设置刷盘策略，Alloc分配出的MMapCache会使用缓存池的刷盘策略
+// 只影响之后Alloc分配出的MMapCache
+func (m *PoolMMapCache) SetSyncPolicy(policy SyncPolicy) {
+	m.stateMu.Lock()
+	defer m.stateMu.Unlock()
+	m.syncPolicy = policy
+}
+
+// SetSyncPolicy 设置刷盘策略
+// 从缓存池分配或reload得到的MMapCache默认使用缓存池的刷盘策略，可通过此方法单独设置
+func (m *MMapCache) SetSyncPolicy(policy SyncPolicy) {
+	m.lock()
+	defer m.unlock()
+	m.syncPolicy = policy
+}
+
+// Flush 将mmap内存同步刷到磁盘
+// 通过ReloadMMapCache从内存对象加载的MMapCache没有对应的文件，已关闭的MMapCache也已解除映射，直接返回nil
+func (m *MMapCache) Flush() error {
+	if nil == m.mmap {
+		return nil
+	}
+	return m.mmap.Flush()
+}
+
+// FlushRange 将mmap内存中 [off, off+n) 的部分同步刷到磁盘
+// off会向下对齐到内存页，off超出文件范围时返回 ErrFlushRange
+func (m *MMapCache) FlushRange(off, n int) error {
+	if nil == m.mmap || n <= 0 {
+		return nil
+	}
+	if off < 0 || off >= len(m.buf) {
+		return fmt.Errorf("%w off:%v len:%v", ErrFlushRange, off, len(m.buf))
+	}
+	end := off + n
+	if end > len(m.buf) {
+		end = len(m.buf)
+	}
+	off -= off % os.Getpagesize()
+	return m.mmap[off:end].Flush()
+}
+
+// sync 每次写入后按刷盘策略决定是否刷盘
+func (m *MMapCache) sync() error {
+	switch m.syncPolicy.Mode {
+	case SyncEveryWrite:
+		return m.Flush()
+	case SyncEveryN:
+		m.syncWrites++
+		if m.syncWrites >= m.syncPolicy.Writes {
+			m.syncWrites = 0
+			return m.Flush()
+		}
+	case SyncInterval:
+		if atomic.CompareAndSwapInt32(&m.syncPending, 0, 1) {
+			m.syncTimer = time.AfterFunc(m.syncPolicy.Interval, func() {
+				m.syncMu.Lock()
+				defer m.syncMu.Unlock()
+				atomic.StoreInt32(&m.syncPending, 0)
+				m.Flush()
+			})
+		}
+	}
+	return nil
+}
+
+// stopSync 关闭文件前停止未触发的定时刷盘
+func (m *MMapCache) stopSync() {
+	if nil != m.syncTimer && m.syncTimer.Stop() {
+		atomic.StoreInt32(&m.syncPending, 0)
+	}
+}
@@ -0,0 +1,155 @@
+package cache
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ErrWriterClosed Writer已关闭
+var ErrWriterClosed = errors.New("mmap cache writer closed")
+
+// WriterOptions Writer的配置
+type WriterOptions struct {
+	// Seal 当前的MMapCache写满（或Rotate、Close）时，通过此函数交出，之后Writer不再使用它
+	// 例如交给Flusher：func(c *MMapCache) { flusher.Submit(c) }，或者发送到channel
+	Seal func(*MMapCache)
+
+	// 封存策略，满足任意一个时当前的MMapCache即使没有写满也会被封存交出，0为不限制
+	MaxAge     time.Duration // 第一次写入后超过此时长，由定时器触发封存
+	MaxRecords int           // 数据块数量达到此值
+	MaxBytes   int           // 已使用的content长度（不含可复用的已删除数据块）达到此值
+}
+
+// Writer 在缓存池之上持有一个正在写入的MMapCache
+// 写满或满足封存策略时，当前的MMapCache被封存（文件头记录封存时间）并通过Seal交出，之后的写入使用新的MMapCache
+// Writer的方法可以在多个goroutine中并发调用
+type Writer struct {
+	pool       *PoolMMapCache
+	seal       func(*MMapCache)
+	maxAge     time.Duration
+	maxRecords int
+	maxBytes   int
+	mu         sync.Mutex
+	active     *MMapCache
+	ageTimer   *time.Timer // MaxAge时，当前MMapCache第一次写入后启动
+	gen        uint64      // 每次rotate递增，定时器据此判断触发时是否还是同一个MMapCache
+	closed     bool
+}
+
+// NewWriter 创建一个Writer，第一次Put时才会从缓存池分配MMapCache
+// Seal为nil时返回 ErrInvalidOptions
+func NewWriter(pool *PoolMMapCache, opts WriterOptions) (*Writer, error) {
+	if nil == opts.Seal {
+		return nil, fmt.Errorf("%w writer seal is nil", ErrInvalidOptions)
+	}
+	if opts.MaxAge < 0 || opts.MaxRecords < 0 || opts.MaxBytes < 0 {
+		return nil, fmt.Errorf("%w writer maxage:%v maxrecords:%v maxbytes:%v",
+			ErrInvalidOptions, opts.MaxAge, opts.MaxRecords, opts.MaxBytes)
+	}
+	return &Writer{
+		pool:       pool,
+		seal:       opts.Seal,
+		maxAge:     opts.MaxAge,
+		maxRecords: opts.MaxRecords,
+		maxBytes:   opts.MaxBytes,
+	}, nil
+}
+
+// Put 写入一片内存对象，当前的MMapCache写满时自动切换到新的MMapCache
+// 返回的error为 ErrDataSizeOverflow、ErrKeySizeOverflow、缓存池Alloc的错误或 ErrWriterClosed
+// 已写入的key在切换之后再次写入时，新的数据写入新的MMapCache，旧的数据随写满的MMapCache一起交出
+func (w *Writer) Put(tag uint16, key, data []byte, val interface{}) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return ErrWriterClosed
+	}
+
+	if nil == w.active {
+		mmcache, err := w.pool.Alloc()
+		if nil != err {
+			return err
+		}
+		w.active = mmcache
+	}
+	n, err := w.active.WriteData(tag, data, key, val)
+	if nil != err {
+		return err
+	}
+	if n < 0 {
+		// 写满了，分配新的MMapCache成功后再交出写满的，分配失败时保持不变，下次Put重试
+		mmcache, err := w.pool.Alloc()
+		if nil != err {
+			return err
+		}
+		w.rotate()
+		w.active = mmcache
+		n, err = w.active.WriteData(tag, data, key, val)
+		if nil != err {
+			return err
+		}
+		if n < 0 {
+			return ErrDataSizeOverflow
+		}
+	}
+	w.checkSeal()
+	return nil
+}
+
+// checkSeal 写入成功后检查封存策略
+func (w *Writer) checkSeal() {
+	if w.maxAge > 0 && nil == w.ageTimer {
+		// 同一个MMapCache被Release回收后可能再次分配给Writer，不能通过指针判断
+		gen := w.gen
+		w.ageTimer = time.AfterFunc(w.maxAge, func() {
+			w.mu.Lock()
+			defer w.mu.Unlock()
+			if w.gen == gen {
+				w.rotate()
+			}
+		})
+	}
+	if w.maxRecords > 0 && w.active.Len() >= w.maxRecords {
+		w.rotate()
+		return
+	}
+	if w.maxBytes > 0 && len(w.active.writeContent)-w.active.GetFreeContentLen() >= w.maxBytes {
+		w.rotate()
+	}
+}
+
+// Rotate 封存并交出当前的MMapCache，下一次Put时分配新的MMapCache
+// 当前的MMapCache没有数据时直接Release
+func (w *Writer) Rotate() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.rotate()
+}
+
+// Close 封存并交出当前的MMapCache，关闭Writer，之后的Put返回 ErrWriterClosed
+func (w *Writer) Close() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.rotate()
+	w.closed = true
+}
+
+func (w *Writer) rotate() {
+	w.gen++
+	if nil != w.ageTimer {
+		w.ageTimer.Stop()
+		w.ageTimer = nil
+	}
+	if nil == w.active {
+		return
+	}
+	if 0 == w.active.Len() {
+		w.active.Release()
+	} else {
+		w.active.Seal()
+		w.seal(w.active)
+	}
+	w.active = nil
+}
@@ -0,0 +1,112 @@
+// mmapreplay 将缓存文件（.cachedat，或被隔离的.err）中的数据导出，用于数据库故障后的恢复
+// 每个数据块输出一行JSON：{"file":...,"tag":...,"key":<base64>,"data":<base64>}，由运维导入数据库
+//
+//	mmapreplay [-out records.jsonl] [-force] file...
+//
+// 文件头损坏时使用-force，忽略文件头的校验，尽量导出其中的数据块
+//
+// 每个文件的结果输出到stderr，有文件或数据块失败时退出码为1
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"mmapcache/cache"
+)
+
+type record struct {
+	File string `json:"file"`
+	Tag  uint16 `json:"tag"`
+	Key  []byte `json:"key"` // key可能是二进制，与data一样输出为base64
+	Data []byte `json:"data"`
+}
+
+// jsonSink 将数据块逐行写为JSON
+type jsonSink struct {
+	file string
+	w    *bufio.Writer
+	enc  *json.Encoder
+}
+
+func newJSONSink(w io.Writer) *jsonSink {
+	bw := bufio.NewWriter(w)
+	return &jsonSink{w: bw, enc: json.NewEncoder(bw)}
+}
+
+func (s *jsonSink) WriteBatch(ctx context.Context, datas []*cache.MMapData) error {
+	for _, mmapData := range datas {
+		err := s.enc.Encode(record{
+			File: s.file,
+			Tag:  mmapData.GetTag(),
+			Key:  mmapData.GetKey(),
+			Data: mmapData.GetData(),
+		})
+		if nil != err {
+			return err
+		}
+	}
+	return nil
+}
+
+func main() {
+	out := flag.String("out", "", "输出文件，默认为stdout")
+	force := flag.Bool("force", false, "忽略文件头的magic、checksum与version校验，尽量导出数据")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %v [-out records.jsonl] [-force] file...\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if 0 == flag.NArg() {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	w := os.Stdout
+	if "" != *out {
+		f, err := os.Create(*out)
+		if nil != err {
+			fmt.Fprintf(os.Stderr, "create %v err:%v\n", *out, err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		w = f
+	}
+	sink := newJSONSink(w)
+
+	failed := false
+	for _, filePath := range flag.Args() {
+		sink.file = filePath
+		report, err := cache.ReplayWith(context.Background(), filePath, sink, cache.ReplayOptions{BestEffort: *force})
+		if nil != err {
+			fmt.Fprintf(os.Stderr, "%v err:%v\n", filePath, err)
+			failed = true
+			continue
+		}
+		for _, result := range report.Results {
+			if nil != result.Err {
+				fmt.Fprintf(os.Stderr, "%v key:%q err:%v\n", filePath, result.Key, result.Err)
+			}
+		}
+		fmt.Fprintf(os.Stderr, "%v version:%v succeeded:%v failed:%v corrupt:%v\n",
+			filePath, report.Version, report.Succeeded, report.Failed, report.Corrupt)
+		if nil != report.ContentErr {
+			fmt.Fprintf(os.Stderr, "%v content err:%v\n", filePath, report.ContentErr)
+		}
+		if report.Failed > 0 || report.Corrupt > 0 || nil != report.ContentErr {
+			failed = true
+		}
+	}
+	if err := sink.w.Flush(); nil != err {
+		fmt.Fprintf(os.Stderr, "flush err:%v\n", err)
+		failed = true
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
@@ -39,7 +39,11 @@ func main() {
 			}
 		})
 
-	mmapCache := cache.DefPoolMMapCache.Alloc()
+	mmapCache, err := cache.DefPoolMMapCache.Alloc()
+	if nil != err {
+		fmt.Printf("alloc err:%v\n", err)
+		return
+	}
 	fmt.Printf("alloc:%v\n", mmapCache.Path())
 	for i := 0; i < 10; i++ {
 		vk := &keyVal{
@@ -63,7 +67,7 @@ func main() {
 	for i := 0; i < wait; i++ {
 		<-time.After(time.Second)
 		alloc, collect, release, size := cache.DefPoolMMapCache.DumpRuntime()
-		fmt.Printf("time.after %v cache.pool alloc:%v collect:%v release:%v size:%v\n",
-			wait-i, alloc, collect, release, size)
+		fmt.Printf("time.after %v cache.pool alloc:%v collect:%v release:%v size:%v live:%v\n",
+			wait-i, alloc, collect, release, size, cache.DefPoolMMapCache.LiveMappings())
 	}
 }
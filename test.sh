@@ -36,7 +36,8 @@ fi
 if [ "$target" == "all" ] || [ "$target" == "mmap" ] ;then
     go get github.com/edsrzf/mmap-go
     cd ./src
-    go test -v ./cache/mmapcache_test.go ./cache/mmapcachepool.go ./cache/mmapcache.go ./cache/mmapdata.go
-    go test -bench=".*" ./cache/mmapcache_test.go ./cache/mmapcachepool.go ./cache/mmapcache.go ./cache/mmapdata.go
-    go test -v ./cache/mmapcachepool_test.go ./cache/mmapcachepool.go ./cache/mmapcache.go ./cache/mmapdata.go
+    go test -v ./cache/mmapcache_test.go ./cache/mmapcachepool.go ./cache/mmapcache.go ./cache/mmapdata.go ./cache/mmapsync.go ./cache/mmapmigrate.go ./cache/mmapoptions.go ./cache/mmapflush.go ./cache/mmapwriter.go ./cache/mmapreplay.go ./cache/mmapprealloc.go ./cache/mmapprealloc_linux.go
+    go test -bench=".*" ./cache/mmapcache_test.go ./cache/mmapcachepool.go ./cache/mmapcache.go ./cache/mmapdata.go ./cache/mmapsync.go ./cache/mmapmigrate.go ./cache/mmapoptions.go ./cache/mmapflush.go ./cache/mmapwriter.go ./cache/mmapreplay.go ./cache/mmapprealloc.go ./cache/mmapprealloc_linux.go
+    go test -v ./cache/mmapcachepool_test.go ./cache/mmapcachepool.go ./cache/mmapcache.go ./cache/mmapdata.go ./cache/mmapsync.go ./cache/mmapmigrate.go ./cache/mmapoptions.go ./cache/mmapflush.go ./cache/mmapwriter.go ./cache/mmapreplay.go ./cache/mmapprealloc.go ./cache/mmapprealloc_linux.go
+    go test -race ./cache/
 fi